@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -40,13 +41,7 @@ func main() {
 	ctx := context.Background()
 
 	// Initialize storage
-	storageClient, err := storage.NewMinioClient(
-		os.Getenv("S3_ENDPOINT"),
-		os.Getenv("S3_ACCESS_KEY"),
-		os.Getenv("S3_SECRET_KEY"),
-		os.Getenv("S3_BUCKET"),
-		os.Getenv("S3_REGION"),
-	)
+	storageClient, err := newStore()
 	if err != nil {
 		log.Fatal("Failed to initialize storage client:", err)
 	}
@@ -65,9 +60,20 @@ func main() {
 	// Initialize auth service
 	authService := auth.NewService(os.Getenv("JWT_SECRET"))
 
+	// Preview URLs get a key of their own, so that leaking it cannot be
+	// used to forge tokens
+	if s := os.Getenv("CONTENT_URL_SECRET"); s == "" || s == os.Getenv("JWT_SECRET") {
+		log.Fatal("CONTENT_URL_SECRET must be set and differ from JWT_SECRET")
+	}
+
 	// Initialize handlers
 	h := handlers.New(storageClient, qdrantClient, authService, os.Getenv("EMBED_URL"))
 
+	// Start background jobs
+	bgCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	h.RunBackground(bgCtx)
+
 	// Setup Gin router
 	r := gin.New()
 	r.Use(gin.Recovery())
@@ -77,7 +83,7 @@ func main() {
 		AllowOrigins:     []string{"http://localhost:3000", "http://localhost:5173"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Range", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -94,6 +100,15 @@ func main() {
 		api.POST("/auth/login", h.Login)
 		api.POST("/auth/register", h.Register)
 
+		// Image bytes, for a bearer token or a signed URL from a listing
+		api.GET("/images/:id/content", h.GetImageContent)
+		api.GET("/images/:id/thumbnail", h.GetImageThumbnail)
+
+		// Presigned URLs of local storage; the signature is the credential
+		if local, ok := storageClient.(*storage.LocalStore); ok {
+			api.Any("/storage/*key", gin.WrapH(http.StripPrefix("/api/storage", local)))
+		}
+
 		// Protected routes
 		protected := api.Group("/")
 		protected.Use(middleware.AuthMiddleware(authService))
@@ -101,19 +116,54 @@ func main() {
 			// Upload & ingest
 			protected.POST("/images/presign", h.GetPresignedURL)
 			protected.POST("/images/ingest", h.IngestImage)
+			protected.POST("/images/ingest-url", h.IngestFromURL)
 			protected.GET("/images", h.ListImages)
+			protected.POST("/images/uploads", h.CreateUpload)
+			protected.GET("/images/uploads/:id", h.GetUpload)
+			protected.POST("/images/uploads/:id/complete", h.CompleteUpload)
+			protected.DELETE("/images/uploads/:id", h.AbortUpload)
 
 			// Search & discovery
 			protected.POST("/search/similar", h.SearchSimilar)
+			protected.POST("/search/recommend", h.Recommend)
+			protected.POST("/search/batch", h.SearchBatch)
 			protected.POST("/search/cluster", h.ClusterImages)
 			protected.POST("/deduplicate", h.Deduplicate)
 
+			// Saved searches
+			protected.GET("/saved-searches", h.ListSavedSearches)
+			protected.POST("/saved-searches", h.CreateSavedSearch)
+			protected.DELETE("/saved-searches/:id", h.DeleteSavedSearch)
+			protected.GET("/saved-searches/:id/matches", h.GetSavedSearchMatches)
+			protected.POST("/saved-searches/:id/matches/seen", h.MarkSavedSearchMatchesSeen)
+
+			// Webhooks
+			protected.GET("/webhooks", h.ListWebhooks)
+			protected.POST("/webhooks", h.CreateWebhook)
+			protected.PATCH("/webhooks/:id", h.UpdateWebhook)
+			protected.DELETE("/webhooks/:id", h.DeleteWebhook)
+			protected.GET("/webhooks/:id/deliveries", h.ListWebhookDeliveries)
+			protected.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", h.RedeliverWebhook)
+
 			protected.DELETE("/images/:id", h.DeleteImage)
 			protected.POST("/images/:id/reindex", h.ReindexImage)
 			protected.POST("/images/:id/thumbnail", h.RegenerateThumbnail)
 
 			protected.POST("/feedback", h.SubmitFeedback)
 			protected.GET("/qa/anomalies", h.GetAnomalies)
+			protected.GET("/qa/reference-sets", h.ListReferenceSets)
+			protected.POST("/qa/reference-sets", h.CreateReferenceSet)
+			protected.DELETE("/qa/reference-sets/:id", h.DeleteReferenceSet)
+			protected.GET("/qa/calibration", h.GetCalibration)
+			protected.POST("/qa/calibration", h.FitCalibration)
+
+			// Anomaly review queue
+			protected.GET("/qa/review", h.ListReviewItems)
+			protected.POST("/qa/review/claim", h.ClaimNextReviewItem)
+			protected.POST("/qa/review/:id/claim", h.ClaimReviewItem)
+			protected.POST("/qa/review/:id/release", h.ReleaseReviewItem)
+			protected.POST("/qa/review/:id/assign", h.AssignReviewItem)
+			protected.POST("/qa/review/:id/transition", h.TransitionReviewItem)
 		}
 	}
 
@@ -142,6 +192,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	logger.Info("Shutting down server...")
+	stopBackground()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -152,6 +203,41 @@ func main() {
 	logger.Info("Server exited")
 }
 
+// newStore opens the storage backend named by STORAGE_BACKEND: "s3" (the
+// default) for an S3-compatible bucket, or "local" for files under
+// LOCAL_STORAGE_DIR whose presigned URLs are served by the API at
+// LOCAL_STORAGE_URL.
+func newStore() (storage.Store, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "s3", "minio":
+		return storage.NewMinioClient(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_REGION"),
+		)
+	case "local":
+		dir := os.Getenv("LOCAL_STORAGE_DIR")
+		if dir == "" {
+			dir = "./data/storage"
+		}
+		baseURL := os.Getenv("LOCAL_STORAGE_URL")
+		if baseURL == "" {
+			baseURL = "/api/storage"
+		}
+		// A key of its own: anyone holding it can mint upload URLs
+		secret := os.Getenv("LOCAL_STORAGE_SECRET")
+		if secret == "" || secret == os.Getenv("JWT_SECRET") {
+			return nil, fmt.Errorf("STORAGE_BACKEND=local needs a LOCAL_STORAGE_SECRET that differs from JWT_SECRET")
+		}
+		slog.Info("Using local storage", "dir", dir, "url", baseURL)
+		return storage.NewLocalStore(dir, baseURL, []byte(secret))
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q (use s3 or local)", backend)
+	}
+}
+
 func runWorker() {
 	// Worker implementation for background jobs
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
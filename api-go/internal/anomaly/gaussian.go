@@ -0,0 +1,78 @@
+package anomaly
+
+import "math"
+
+// varianceFloor regularizes dimensions with (near) zero variance, which are
+// common when a reference set only holds a handful of images. Without it a
+// tiny deviation in such a dimension would dominate the distance.
+const varianceFloor = 1e-4
+
+// Gaussian models a population of L2-normalized embeddings with a mean and a
+// diagonal covariance. A full 512x512 covariance cannot be estimated from the
+// few dozen images a reference set usually has.
+type Gaussian struct {
+	Mean     []float64
+	Variance []float64
+}
+
+// FitGaussian estimates the per-dimension mean and variance of vectors.
+func FitGaussian(vectors [][]float32) *Gaussian {
+	if len(vectors) == 0 {
+		return &Gaussian{}
+	}
+	dim := len(vectors[0])
+	mean := make([]float64, dim)
+	variance := make([]float64, dim)
+	normalized := make([][]float64, 0, len(vectors))
+	for _, v := range vectors {
+		n := normalize(v, dim)
+		normalized = append(normalized, n)
+		for i, x := range n {
+			mean[i] += x
+		}
+	}
+	for i := range mean {
+		mean[i] /= float64(len(normalized))
+	}
+	for _, n := range normalized {
+		for i, x := range n {
+			d := x - mean[i]
+			variance[i] += d * d
+		}
+	}
+	for i := range variance {
+		variance[i] = variance[i]/float64(len(normalized)) + varianceFloor
+	}
+	return &Gaussian{Mean: mean, Variance: variance}
+}
+
+// Distance is the Mahalanobis distance of v to the distribution, divided by
+// the square root of the dimension so that it reads as an RMS z-score.
+func (g *Gaussian) Distance(v []float32) float64 {
+	if len(g.Mean) == 0 {
+		return 0
+	}
+	var sum float64
+	for i, x := range normalize(v, len(g.Mean)) {
+		d := x - g.Mean[i]
+		sum += d * d / g.Variance[i]
+	}
+	return math.Sqrt(sum / float64(len(g.Mean)))
+}
+
+func normalize(v []float32, dim int) []float64 {
+	out := make([]float64, dim)
+	var norm float64
+	for i := 0; i < dim && i < len(v); i++ {
+		out[i] = float64(v[i])
+		norm += out[i] * out[i]
+	}
+	if norm == 0 {
+		return out
+	}
+	norm = math.Sqrt(norm)
+	for i := range out {
+		out[i] /= norm
+	}
+	return out
+}
@@ -0,0 +1,319 @@
+package anomaly
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+// Payload fields written by the Job.
+const (
+	ScoreField      = "anomaly_score"
+	MethodField     = "anomaly_method"
+	ComputedAtField = "anomaly_computed_at"
+)
+
+const storeChunkSize = 256
+
+// reverseCandidates is how many of a changed point's nearest points, as a
+// multiple of k, are checked for having it among their own k nearest.
+// Points farther away whose k-NN lists change keep their score until the
+// next full pass.
+const reverseCandidates = 4
+
+// Change is an ingest or delete that affects the scores of the points around
+// Vector.
+type Change struct {
+	ID      interface{}
+	Vector  []float32
+	Deleted bool
+}
+
+// Job keeps the anomaly_score payload field of every point up to date. It
+// scores the whole collection on start and every interval, and in between
+// only rescores the neighbourhoods touched by the changes it is notified of.
+type Job struct {
+	client   *qdrant.Client
+	method   Method
+	k        int
+	interval time.Duration
+	changes  chan Change
+
+	// OnScored, when set, is called with every batch of freshly stored
+	// scores. It must be set before Run is started.
+	OnScored func(ctx context.Context, results []Result)
+
+	mu         sync.RWMutex
+	computedAt time.Time
+	// population is fitted by the last full pass and used to score changed
+	// points with the centroid and Mahalanobis methods.
+	population func(v []float32) float64
+}
+
+func NewJob(client *qdrant.Client, method Method, k int, interval time.Duration) *Job {
+	return &Job{
+		client:   client,
+		method:   method,
+		k:        k,
+		interval: interval,
+		changes:  make(chan Change, 1024),
+	}
+}
+
+func (j *Job) Method() Method { return j.method }
+
+func (j *Job) K() int { return j.k }
+
+// ComputedAt is the time the last recompute finished, zero until the first
+// full pass has completed.
+func (j *Job) ComputedAt() time.Time {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.computedAt
+}
+
+// Notify queues a change for incremental rescoring. It never blocks: when the
+// queue is full the change is dropped and picked up by the next full pass.
+func (j *Job) Notify(ch Change) {
+	select {
+	case j.changes <- ch:
+	default:
+		slog.Warn("anomaly: change queue full, deferring to next full recompute", "point_id", ch.ID)
+	}
+}
+
+// Run processes changes and periodic full recomputes until ctx is done.
+func (j *Job) Run(ctx context.Context) {
+	if err := j.RecomputeAll(ctx); err != nil {
+		slog.Error("anomaly: full recompute failed", "error", err)
+	}
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.RecomputeAll(ctx); err != nil {
+				slog.Error("anomaly: full recompute failed", "error", err)
+			}
+		case ch := <-j.changes:
+			batch := []Change{ch}
+		drain:
+			for {
+				select {
+				case ch := <-j.changes:
+					batch = append(batch, ch)
+				default:
+					break drain
+				}
+			}
+			if err := j.applyChanges(ctx, batch); err != nil {
+				slog.Error("anomaly: incremental recompute failed", "error", err, "changes", len(batch))
+			}
+		}
+	}
+}
+
+// RecomputeAll scores every point in the collection.
+func (j *Job) RecomputeAll(ctx context.Context) error {
+	points, err := j.client.ScrollAll(ctx, nil, true)
+	if err != nil {
+		return err
+	}
+	cache := NewPointCache(j.client, points)
+	samples := make([]Sample, 0, len(points))
+	vectors := make([][]float32, 0, len(points))
+	for _, p := range points {
+		samples = append(samples, Sample{ID: p.ID, Vector: p.Vector})
+		vectors = append(vectors, p.Vector)
+	}
+
+	graph := NewGraph(j.k, SearchNeighbors(j.client, cache.Vector, nil))
+	results, err := Score(ctx, j.method, samples, graph)
+	if err != nil {
+		return err
+	}
+	if err := j.store(ctx, results); err != nil {
+		return err
+	}
+
+	center, gaussian := Centroid(vectors), FitGaussian(vectors)
+	j.mu.Lock()
+	if j.method == MethodMahalanobis {
+		j.population = gaussian.Distance
+	} else {
+		j.population = func(v []float32) float64 { return CosineDistance(v, center) }
+	}
+	j.mu.Unlock()
+	slog.Info("anomaly: full recompute done", "points", len(results), "method", j.method)
+	return nil
+}
+
+// applyChanges rescores the changed points and the points whose k-NN lists
+// a change enters or leaves (its reverse neighbours). For LOF the reverse
+// neighbours of those are added too, as their reachability densities
+// change, and then the forward neighbours of all of them, whose LOF
+// compares against those densities.
+func (j *Job) applyChanges(ctx context.Context, changes []Change) error {
+	j.mu.RLock()
+	population := j.population
+	j.mu.RUnlock()
+	if population == nil {
+		return j.RecomputeAll(ctx)
+	}
+	fitted := j.method == MethodCentroid || j.method == MethodMahalanobis
+
+	cache := NewPointCache(j.client, nil)
+	graph := NewGraph(j.k, SearchNeighbors(j.client, cache.Vector, nil))
+
+	affected := map[string]interface{}{}
+	deleted := map[string]bool{}
+	for _, ch := range changes {
+		if ch.Deleted {
+			deleted[IDKey(ch.ID)] = true
+		} else {
+			affected[IDKey(ch.ID)] = ch.ID
+		}
+		if fitted {
+			continue
+		}
+		reverse, err := j.reverseNeighbors(ctx, graph, ch.ID, ch.Vector)
+		if err != nil {
+			return err
+		}
+		for key, id := range reverse {
+			affected[key] = id
+		}
+	}
+
+	if j.method == MethodLOF {
+		for _, id := range copyIDs(affected) {
+			if deleted[IDKey(id)] {
+				continue
+			}
+			vector, err := cache.Vector(ctx, id)
+			if err != nil {
+				continue
+			}
+			reverse, err := j.reverseNeighbors(ctx, graph, id, vector)
+			if err != nil {
+				return err
+			}
+			for key, rid := range reverse {
+				affected[key] = rid
+			}
+		}
+		for _, id := range copyIDs(affected) {
+			nb, err := graph.Neighbors(ctx, id)
+			if err != nil {
+				continue
+			}
+			for _, n := range nb {
+				affected[IDKey(n.ID)] = n.ID
+			}
+		}
+	}
+
+	samples := make([]Sample, 0, len(affected))
+	for key, id := range affected {
+		if deleted[key] {
+			continue
+		}
+		p, err := cache.Get(ctx, id)
+		if err != nil {
+			continue // deleted in the meantime
+		}
+		samples = append(samples, Sample{ID: p.ID, Vector: p.Vector})
+	}
+
+	var results []Result
+	if fitted {
+		// Keep the population fitted by the last full pass, one image barely
+		// moves it.
+		for _, s := range samples {
+			results = append(results, Result{ID: s.ID, Score: population(s.Vector)})
+		}
+	} else {
+		var err error
+		results, err = Score(ctx, j.method, samples, graph)
+		if err != nil {
+			return err
+		}
+	}
+	return j.store(ctx, results)
+}
+
+// reverseNeighbors returns the points near vector whose k nearest
+// neighbours include, or included before it was deleted, the point id:
+// those no farther from it than their own k-th neighbour. Only the
+// reverseCandidates*k nearest points are checked.
+func (j *Job) reverseNeighbors(ctx context.Context, graph *Graph, id interface{}, vector []float32) (map[string]interface{}, error) {
+	candidates, err := j.client.Search(ctx, qdrant.SearchRequest{
+		Vector:     vector,
+		Limit:      reverseCandidates * j.k,
+		ExcludeIDs: []interface{}{id},
+	})
+	if err != nil {
+		return nil, err
+	}
+	reverse := map[string]interface{}{}
+	for _, c := range candidates {
+		nb, err := graph.Neighbors(ctx, c.ID)
+		if err != nil {
+			continue // deleted in the meantime
+		}
+		if len(nb) < j.k || 1-float64(c.Score) <= nb[len(nb)-1].Distance {
+			reverse[IDKey(c.ID)] = c.ID
+		}
+	}
+	return reverse, nil
+}
+
+func (j *Job) store(ctx context.Context, results []Result) error {
+	now := time.Now().UTC()
+	payloads := make(map[interface{}]qdrant.Payload, len(results))
+	for _, r := range results {
+		payloads[r.ID] = qdrant.Payload{
+			ScoreField:      r.Score,
+			MethodField:     string(j.method),
+			ComputedAtField: now.Format(time.RFC3339),
+		}
+	}
+	// Flush in chunks to keep request bodies bounded on large collections.
+	for len(payloads) > 0 {
+		chunk := make(map[interface{}]qdrant.Payload, storeChunkSize)
+		for id, p := range payloads {
+			chunk[id] = p
+			delete(payloads, id)
+			if len(chunk) == storeChunkSize {
+				break
+			}
+		}
+		if err := j.client.SetPayloads(ctx, chunk); err != nil {
+			return err
+		}
+	}
+
+	j.mu.Lock()
+	j.computedAt = now
+	j.mu.Unlock()
+
+	if j.OnScored != nil && len(results) > 0 {
+		j.OnScored(ctx, results)
+	}
+	return nil
+}
+
+func copyIDs(m map[string]interface{}) []interface{} {
+	ids := make([]interface{}, 0, len(m))
+	for _, id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
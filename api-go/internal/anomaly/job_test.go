@@ -0,0 +1,104 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+// fakeQdrant serves search, retrieve and payload updates over points on
+// the unit circle, and records the IDs whose payload was set.
+func fakeQdrant(t *testing.T, degrees map[int]float64) (*qdrant.Client, map[string]bool) {
+	t.Helper()
+	vectors := map[int][]float32{}
+	for id, d := range degrees {
+		r := d * math.Pi / 180
+		vectors[id] = []float32{float32(math.Cos(r)), float32(math.Sin(r))}
+	}
+	scored := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Vector []float32
+			Limit  int
+			Filter struct {
+				MustNot []struct {
+					HasID []int `json:"has_id"`
+				} `json:"must_not"`
+			}
+			IDs        []int
+			Operations []struct {
+				SetPayload struct{ Points []int } `json:"set_payload"`
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/points/search"):
+			excluded := map[int]bool{}
+			for _, m := range req.Filter.MustNot {
+				for _, id := range m.HasID {
+					excluded[id] = true
+				}
+			}
+			var hits []qdrant.SearchResult
+			for id, v := range vectors {
+				if !excluded[id] {
+					hits = append(hits, qdrant.SearchResult{ID: id, Score: v[0]*req.Vector[0] + v[1]*req.Vector[1]})
+				}
+			}
+			sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+			if len(hits) > req.Limit {
+				hits = hits[:req.Limit]
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": hits})
+		case strings.HasSuffix(r.URL.Path, "/points/batch"):
+			for _, op := range req.Operations {
+				for _, id := range op.SetPayload.Points {
+					scored[fmt.Sprint(id)] = true
+				}
+			}
+			w.Write([]byte(`{"result": []}`))
+		case strings.HasSuffix(r.URL.Path, "/points"):
+			var pts []qdrant.Point
+			for _, id := range req.IDs {
+				if v, ok := vectors[id]; ok {
+					pts = append(pts, qdrant.Point{ID: id, Vector: v})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"result": pts})
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client, _ := qdrant.NewClient(srv.URL, "")
+	return client, scored
+}
+
+func TestApplyChangesRescoresReverseNeighbors(t *testing.T) {
+	// 1 and 2 are each other's nearest neighbour. 3 is isolated, its
+	// nearest neighbour 2 is 59 degrees away. The new point 4 has 2 as its
+	// nearest neighbour, but is nearer to 3 than 2 is, so it enters 3's
+	// neighbourhood.
+	client, scored := fakeQdrant(t, map[int]float64{1: 0, 2: 1, 3: 60, 4: 20})
+	j := NewJob(client, MethodKNN, 1, 0)
+	j.population = func([]float32) float64 { return 0 }
+
+	r := 20 * math.Pi / 180
+	change := Change{ID: 4, Vector: []float32{float32(math.Cos(r)), float32(math.Sin(r))}}
+	if err := j.applyChanges(context.Background(), []Change{change}); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{"1": false, "2": false, "3": true, "4": true} {
+		if scored[id] != want {
+			t.Errorf("point %s rescored: %v, want %v", id, scored[id], want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+// VectorLookup returns the stored vector of a point.
+type VectorLookup func(ctx context.Context, id interface{}) ([]float32, error)
+
+// SearchNeighbors returns a NeighborFunc backed by Qdrant vector search. The
+// query point itself is excluded by ID and filter restricts which points may
+// be neighbours.
+func SearchNeighbors(client *qdrant.Client, vectors VectorLookup, filter map[string]interface{}) NeighborFunc {
+	return func(ctx context.Context, id interface{}, k int) ([]Neighbor, error) {
+		vector, err := vectors(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		results, err := client.Search(ctx, qdrant.SearchRequest{
+			Vector:     vector,
+			Filter:     filter,
+			Limit:      k,
+			ExcludeIDs: []interface{}{id},
+		})
+		if err != nil {
+			return nil, err
+		}
+		neighbors := make([]Neighbor, 0, len(results))
+		for _, r := range results {
+			neighbors = append(neighbors, Neighbor{ID: r.ID, Distance: 1 - float64(r.Score)})
+		}
+		return neighbors, nil
+	}
+}
+
+// PointCache is a VectorLookup over points that are already in memory, which
+// fetches and remembers missing points from Qdrant on demand.
+type PointCache struct {
+	client *qdrant.Client
+	points map[string]qdrant.Point
+}
+
+func NewPointCache(client *qdrant.Client, points []qdrant.Point) *PointCache {
+	pc := &PointCache{client: client, points: make(map[string]qdrant.Point, len(points))}
+	for _, p := range points {
+		pc.points[IDKey(p.ID)] = p
+	}
+	return pc
+}
+
+func (pc *PointCache) Get(ctx context.Context, id interface{}) (qdrant.Point, error) {
+	if p, ok := pc.points[IDKey(id)]; ok {
+		return p, nil
+	}
+	pts, err := pc.client.RetrievePoints(ctx, []interface{}{id}, true)
+	if err != nil {
+		return qdrant.Point{}, err
+	}
+	if len(pts) == 0 {
+		return qdrant.Point{}, fmt.Errorf("point not found: %v", id)
+	}
+	pc.points[IDKey(id)] = pts[0]
+	return pts[0], nil
+}
+
+func (pc *PointCache) Vector(ctx context.Context, id interface{}) ([]float32, error) {
+	p, err := pc.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Vector) == 0 {
+		return nil, fmt.Errorf("point has no vector: %v", id)
+	}
+	return p.Vector, nil
+}
@@ -0,0 +1,250 @@
+// Package anomaly scores how unusual an image embedding is compared to the
+// rest of the collection.
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+type Method string
+
+const (
+	// MethodKNN scores a point by the mean distance to its k nearest neighbours.
+	MethodKNN Method = "knn"
+	// MethodLOF scores a point by its Local Outlier Factor.
+	MethodLOF Method = "lof"
+	// MethodCentroid scores a point by its distance to the population centroid.
+	MethodCentroid Method = "centroid"
+	// MethodMahalanobis scores a point by its Mahalanobis distance to the
+	// population, modelled as a Gaussian with diagonal covariance.
+	MethodMahalanobis Method = "mahalanobis"
+)
+
+func ParseMethod(s string) (Method, error) {
+	switch m := Method(s); m {
+	case MethodKNN, MethodLOF, MethodCentroid, MethodMahalanobis:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown anomaly method %q (want knn, lof, centroid or mahalanobis)", s)
+}
+
+// Sample is a point that takes part in scoring.
+type Sample struct {
+	ID     interface{}
+	Vector []float32
+}
+
+// Neighbor is a nearby point and its cosine distance (1 - cosine similarity).
+type Neighbor struct {
+	ID       interface{}
+	Distance float64
+}
+
+// Result is the anomaly score of a single sample. Higher is more anomalous.
+type Result struct {
+	ID    interface{}
+	Score float64
+}
+
+// NeighborFunc returns the k nearest neighbours of the point with the given
+// ID, excluding the point itself, ordered by increasing distance.
+type NeighborFunc func(ctx context.Context, id interface{}, k int) ([]Neighbor, error)
+
+// Graph lazily builds the k-NN graph through a NeighborFunc and memoizes the
+// neighbourhoods it has already fetched, so that LOF only queries each point
+// once.
+type Graph struct {
+	k     int
+	fetch NeighborFunc
+	cache map[string][]Neighbor
+}
+
+func NewGraph(k int, fetch NeighborFunc) *Graph {
+	return &Graph{k: k, fetch: fetch, cache: map[string][]Neighbor{}}
+}
+
+func (g *Graph) Neighbors(ctx context.Context, id interface{}) ([]Neighbor, error) {
+	key := IDKey(id)
+	if nb, ok := g.cache[key]; ok {
+		return nb, nil
+	}
+	nb, err := g.fetch(ctx, id, g.k)
+	if err != nil {
+		return nil, err
+	}
+	g.cache[key] = nb
+	return nb, nil
+}
+
+// KNNScore is the mean distance to the k nearest neighbours.
+func (g *Graph) KNNScore(ctx context.Context, id interface{}) (float64, error) {
+	nb, err := g.Neighbors(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if len(nb) == 0 {
+		return 1, nil
+	}
+	var sum float64
+	for _, n := range nb {
+		sum += n.Distance
+	}
+	return sum / float64(len(nb)), nil
+}
+
+// LOF is the Local Outlier Factor: the ratio between the average local
+// reachability density of a point's neighbours and its own. Values around 1
+// are inliers, values well above 1 are outliers.
+func (g *Graph) LOF(ctx context.Context, id interface{}) (float64, error) {
+	nb, err := g.Neighbors(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if len(nb) == 0 {
+		return 1, nil
+	}
+	lrd, err := g.lrd(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	var sum float64
+	for _, n := range nb {
+		l, err := g.lrd(ctx, n.ID)
+		if err != nil {
+			return 0, err
+		}
+		sum += l
+	}
+	if math.IsInf(lrd, 1) {
+		// Duplicates of the point sit at distance zero, it cannot be an outlier.
+		return 1, nil
+	}
+	return sum / float64(len(nb)) / lrd, nil
+}
+
+func (g *Graph) kDistance(ctx context.Context, id interface{}) (float64, error) {
+	nb, err := g.Neighbors(ctx, id)
+	if err != nil || len(nb) == 0 {
+		return 0, err
+	}
+	return nb[len(nb)-1].Distance, nil
+}
+
+// lrd is the local reachability density of a point.
+func (g *Graph) lrd(ctx context.Context, id interface{}) (float64, error) {
+	nb, err := g.Neighbors(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if len(nb) == 0 {
+		return 0, nil
+	}
+	var sum float64
+	for _, n := range nb {
+		kd, err := g.kDistance(ctx, n.ID)
+		if err != nil {
+			return 0, err
+		}
+		sum += math.Max(kd, n.Distance)
+	}
+	if sum == 0 {
+		return math.Inf(1), nil
+	}
+	return float64(len(nb)) / sum, nil
+}
+
+// Score computes the anomaly score of every sample with the given method,
+// using the samples themselves as the reference population. The graph is only
+// used by the neighbour based methods.
+func Score(ctx context.Context, method Method, samples []Sample, g *Graph) ([]Result, error) {
+	return ScoreAgainst(ctx, method, samples, samples, g)
+}
+
+// ScoreAgainst scores samples relative to a reference population. The
+// centroid and Mahalanobis methods are fitted on the reference vectors; for
+// the neighbour based methods the graph must only return reference points as
+// neighbours.
+func ScoreAgainst(ctx context.Context, method Method, samples, reference []Sample, g *Graph) ([]Result, error) {
+	results := make([]Result, 0, len(samples))
+	switch method {
+	case MethodCentroid, MethodMahalanobis:
+		vectors := make([][]float32, 0, len(reference))
+		for _, s := range reference {
+			vectors = append(vectors, s.Vector)
+		}
+		var distance func(v []float32) float64
+		if method == MethodCentroid {
+			center := Centroid(vectors)
+			distance = func(v []float32) float64 { return CosineDistance(v, center) }
+		} else {
+			distance = FitGaussian(vectors).Distance
+		}
+		for _, s := range samples {
+			results = append(results, Result{ID: s.ID, Score: distance(s.Vector)})
+		}
+	case MethodKNN, MethodLOF:
+		for _, s := range samples {
+			var score float64
+			var err error
+			if method == MethodLOF {
+				score, err = g.LOF(ctx, s.ID)
+			} else {
+				score, err = g.KNNScore(ctx, s.ID)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("score point %v: %w", s.ID, err)
+			}
+			results = append(results, Result{ID: s.ID, Score: score})
+		}
+	default:
+		return nil, fmt.Errorf("unknown anomaly method %q", method)
+	}
+	return results, nil
+}
+
+// SortDesc orders results from most to least anomalous.
+func SortDesc(results []Result) {
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+}
+
+// Centroid returns the mean of the given vectors.
+func Centroid(vectors [][]float32) []float32 {
+	if len(vectors) == 0 {
+		return nil
+	}
+	sum := make([]float64, len(vectors[0]))
+	for _, v := range vectors {
+		for i := range sum {
+			if i < len(v) {
+				sum[i] += float64(v[i])
+			}
+		}
+	}
+	center := make([]float32, len(sum))
+	for i, s := range sum {
+		center[i] = float32(s / float64(len(vectors)))
+	}
+	return center
+}
+
+// CosineDistance returns 1 - cosine similarity of a and b.
+func CosineDistance(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot/(math.Sqrt(na)*math.Sqrt(nb))
+}
+
+// IDKey returns a comparable key for a Qdrant point ID.
+func IDKey(id interface{}) string {
+	return fmt.Sprint(id)
+}
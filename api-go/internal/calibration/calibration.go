@@ -0,0 +1,76 @@
+// Package calibration fits decision thresholds on labelled scores.
+package calibration
+
+import "sort"
+
+// Sample is a scored item with its ground-truth label. Items scoring at or
+// above a threshold are predicted positive.
+type Sample struct {
+	Score    float64
+	Positive bool
+}
+
+// Point is one operating point of a precision/recall curve.
+type Point struct {
+	Threshold float64 `json:"threshold"`
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+	TP        int     `json:"tp"`
+	FP        int     `json:"fp"`
+	FN        int     `json:"fn"`
+}
+
+// Curve returns one operating point per distinct score, from the highest
+// threshold to the lowest.
+func Curve(samples []Sample) []Point {
+	sorted := append([]Sample(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Score > sorted[j].Score })
+
+	positives := 0
+	for _, s := range sorted {
+		if s.Positive {
+			positives++
+		}
+	}
+
+	var curve []Point
+	tp, fp := 0, 0
+	for i, s := range sorted {
+		if s.Positive {
+			tp++
+		} else {
+			fp++
+		}
+		// Only emit a point once all samples sharing this score are counted.
+		if i+1 < len(sorted) && sorted[i+1].Score == s.Score {
+			continue
+		}
+		p := Point{Threshold: s.Score, TP: tp, FP: fp, FN: positives - tp}
+		p.Precision = ratio(tp, tp+fp)
+		p.Recall = ratio(tp, positives)
+		if p.Precision+p.Recall > 0 {
+			p.F1 = 2 * p.Precision * p.Recall / (p.Precision + p.Recall)
+		}
+		curve = append(curve, p)
+	}
+	return curve
+}
+
+// Best returns the operating point with the highest F1, preferring the
+// higher threshold on ties. ok is false when no point has a positive F1.
+func Best(curve []Point) (best Point, ok bool) {
+	for _, p := range curve {
+		if p.F1 > best.F1 {
+			best, ok = p, true
+		}
+	}
+	return best, ok
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
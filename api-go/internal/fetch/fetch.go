@@ -0,0 +1,168 @@
+// Package fetch talks to user-supplied URLs, such as images to download or
+// webhook endpoints, without letting them reach internal services (SSRF).
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/visual-anomaly/api-go/internal/imaging"
+)
+
+var (
+	// ErrBlockedAddress is returned when the URL resolves to an address
+	// that must not be contacted, such as loopback or a private network.
+	ErrBlockedAddress = errors.New("address not allowed")
+	// ErrTooLarge is returned when the response exceeds the size limit.
+	ErrTooLarge = errors.New("response too large")
+	// ErrNotImage is returned when the content is not sniffed as an image.
+	ErrNotImage = errors.New("content is not an image")
+)
+
+const maxRedirects = 3
+
+// blockedNets are ranges not covered by the net.IP predicates used in
+// allowed: "this network", carrier-grade NAT, benchmarking and reserved.
+var blockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func allowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewClient returns an HTTP client for user-supplied URLs. Every connection
+// is checked after DNS resolution, so redirects and DNS rebinding cannot
+// reach blocked addresses. allowPrivate disables the address checks, for
+// local development only.
+func NewClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !allowed(ip) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{
+		// No proxy: a proxy would connect on our behalf and bypass the
+		// address checks.
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return CheckURL(req.URL)
+		},
+	}
+}
+
+// Fetcher downloads images over HTTP(S) with a client from NewClient.
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// NewFetcher returns a Fetcher that gives up after timeout and rejects
+// bodies larger than maxBytes.
+func NewFetcher(maxBytes int64, timeout time.Duration, allowPrivate bool) *Fetcher {
+	return &Fetcher{client: NewClient(timeout, allowPrivate), maxBytes: maxBytes}
+}
+
+// CheckURL rejects URLs that are not plain http or https, or that carry
+// credentials.
+func CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("URLs with credentials are not allowed")
+	}
+	return nil
+}
+
+// Image downloads rawURL and returns the body and its sniffed content type.
+// The declared Content-Type is ignored; the body must sniff as an image.
+func (f *Fetcher) Image(ctx context.Context, rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid URL: %w", err)
+	}
+	if err := CheckURL(u); err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetch failed: %s", resp.Status)
+	}
+	if resp.ContentLength > f.maxBytes {
+		return nil, "", fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, resp.ContentLength, f.maxBytes)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > f.maxBytes {
+		return nil, "", fmt.Errorf("%w: limit %d bytes", ErrTooLarge, f.maxBytes)
+	}
+
+	// http.DetectContentType knows neither TIFF nor HEIC/AVIF
+	contentType := http.DetectContentType(data)
+	if format := imaging.Sniff(data); format != "" {
+		contentType = imaging.ContentType(format)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("%w: %s", ErrNotImage, contentType)
+	}
+	return data, contentType, nil
+}
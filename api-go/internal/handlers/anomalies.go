@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/visual-anomaly/api-go/internal/anomaly"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+const defaultAnomalyK = 5
+
+type anomalyQuery struct {
+	method    anomaly.Method
+	k         int
+	limit     int
+	offset    int
+	threshold *float64
+	reference *referenceSet
+}
+
+type anomalyHit struct {
+	point qdrant.Point
+	score float64
+}
+
+// GetAnomalies lists images by anomaly score. When the requested method and k
+// match the background job, it reads the persisted anomaly_score payload with
+// a sorted scroll; otherwise, or with live=true, the scores are computed on
+// the fly. With reference_set, images outside the set are scored by their
+// distance to the set's members only.
+func (h *Handlers) GetAnomalies(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	method, err := anomaly.ParseMethod(c.DefaultQuery("method", string(h.anomalyJob.Method())))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q := anomalyQuery{
+		method: method,
+		k:      queryInt(c, "k", h.anomalyJob.K(), 1, 50),
+		limit:  queryInt(c, "limit", 50, 1, 200),
+		offset: queryInt(c, "offset", 0, 0, 10000),
+	}
+	if v := c.Query("threshold"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid threshold"})
+			return
+		}
+		q.threshold = &t
+	}
+
+	ctx := c.Request.Context()
+
+	if name := c.Query("reference_set"); name != "" {
+		rs, err := h.getReferenceSet(ctx, name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load reference set"})
+			return
+		}
+		if rs == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "reference set not found"})
+			return
+		}
+		q.reference = rs
+	}
+
+	var hits []anomalyHit
+	var total int
+	computedAt := h.anomalyJob.ComputedAt()
+	source := "persisted"
+	if c.Query("live") == "true" || q.reference != nil || q.method != h.anomalyJob.Method() || q.k != h.anomalyJob.K() || computedAt.IsZero() {
+		source = "live"
+		computedAt = time.Now().UTC()
+		hits, total, err = h.liveAnomalies(ctx, q)
+	} else {
+		hits, total, err = h.persistedAnomalies(ctx, q)
+	}
+	if err != nil {
+		slog.Error("GetAnomalies: scoring failed", "error", err, "method", q.method, "source", source)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to score images"})
+		return
+	}
+
+	// Images at or above the calibrated threshold are flagged. The threshold
+	// is fitted on corpus-wide scores, so it does not apply to other methods
+	// or to reference sets.
+	var flagThreshold *float64
+	if q.reference == nil && q.method == h.anomalyJob.Method() && q.k == h.anomalyJob.K() {
+		if t, ok := h.calibratedThreshold(ctx, userID, calibrationAnomaly); ok {
+			flagThreshold = &t
+		}
+	}
+
+	srcs := make([]thumbnailSource, len(hits))
+	for i, hit := range hits {
+		srcs[i] = thumbnailSource{ID: hit.point.ID, Payload: hit.point.Payload}
+	}
+	thumbURLs := h.thumbnailURLs(ctx, srcs, queryInt(c, "thumbnail_size", 0, 0, 4096))
+
+	anomalies := make([]gin.H, 0, len(hits))
+	for i, hit := range hits {
+		p := hit.point
+		var previewURL string
+		if _, ok := p.Payload["key"].(string); ok {
+			previewURL = h.contentURL(p.ID, "content", 0)
+		}
+		// Incremental updates only rescore the neighbourhood of a change,
+		// so persisted scores can be older than the response's computed_at.
+		var scoredAt interface{} = computedAt
+		if source == "persisted" {
+			scoredAt = p.Payload[anomaly.ComputedAtField]
+		}
+		anomalies = append(anomalies, gin.H{
+			"image_id":      fmt.Sprintf("%v", p.ID),
+			"anomaly_score": hit.score,
+			"computed_at":   scoredAt,
+			"payload":       p.Payload,
+			"preview_url":   previewURL,
+			"thumbnail_url": thumbURLs[i],
+			"flagged":       flagThreshold != nil && hit.score >= *flagThreshold,
+		})
+	}
+
+	var referenceName interface{}
+	if q.reference != nil {
+		referenceName = q.reference.Name
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"anomalies":      anomalies,
+		"count":          len(anomalies),
+		"total":          total,
+		"method":         q.method,
+		"k":              q.k,
+		"limit":          q.limit,
+		"offset":         q.offset,
+		"source":         source,
+		"computed_at":    computedAt,
+		"reference_set":  referenceName,
+		"flag_threshold": flagThreshold,
+	})
+}
+
+// persistedAnomalies reads the scores written by the anomaly job, most
+// anomalous first.
+func (h *Handlers) persistedAnomalies(ctx context.Context, q anomalyQuery) ([]anomalyHit, int, error) {
+	// Scores can be negative, so without a threshold every scored point
+	// is listed
+	filter := map[string]interface{}{anomaly.ScoreField: qdrant.Exists{}}
+	if q.threshold != nil {
+		filter[anomaly.ScoreField] = qdrant.Range{GTE: q.threshold}
+	}
+
+	total, err := h.qdrant.Count(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Ordered scrolls cannot be resumed from an offset, so fetch up to the
+	// end of the requested page and cut it out.
+	points, _, err := h.qdrant.ScrollPage(ctx, qdrant.ScrollRequest{
+		Filter:  filter,
+		Limit:   q.offset + q.limit,
+		OrderBy: &qdrant.OrderBy{Key: anomaly.ScoreField, Direction: "desc"},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	page := paginate(points, q.offset, q.limit)
+	hits := make([]anomalyHit, 0, len(page))
+	for _, p := range page {
+		hits = append(hits, anomalyHit{point: p, score: payloadFloat(p.Payload, anomaly.ScoreField)})
+	}
+	return hits, total, nil
+}
+
+// liveAnomalies scores the whole collection (no user filtering for learning
+// project) with one neighbour search per point. With a reference set, only
+// non-members are scored and only members act as neighbours.
+func (h *Handlers) liveAnomalies(ctx context.Context, q anomalyQuery) ([]anomalyHit, int, error) {
+	points, err := h.qdrant.ScrollAll(ctx, map[string]interface{}{}, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cache := anomaly.NewPointCache(h.qdrant, points)
+	var samples, reference []anomaly.Sample
+	var neighborFilter map[string]interface{}
+	for _, p := range points {
+		s := anomaly.Sample{ID: p.ID, Vector: p.Vector}
+		if q.reference != nil && q.reference.contains(p.Payload) {
+			reference = append(reference, s)
+			continue
+		}
+		samples = append(samples, s)
+	}
+	if q.reference != nil {
+		if len(reference) == 0 {
+			return nil, 0, nil
+		}
+		neighborFilter = q.reference.filter()
+	} else {
+		reference = samples
+	}
+
+	graph := anomaly.NewGraph(q.k, anomaly.SearchNeighbors(h.qdrant, cache.Vector, neighborFilter))
+	results, err := anomaly.ScoreAgainst(ctx, q.method, samples, reference, graph)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if q.threshold != nil {
+		kept := results[:0]
+		for _, r := range results {
+			if r.Score >= *q.threshold {
+				kept = append(kept, r)
+			}
+		}
+		results = kept
+	}
+	anomaly.SortDesc(results)
+
+	page := paginate(results, q.offset, q.limit)
+	hits := make([]anomalyHit, 0, len(page))
+	for _, r := range page {
+		p, _ := cache.Get(ctx, r.ID)
+		hits = append(hits, anomalyHit{point: p, score: r.Score})
+	}
+	return hits, len(results), nil
+}
+
+// payloadFloat reads a numeric payload field, which Qdrant responses decode
+// as json.Number.
+func payloadFloat(p qdrant.Payload, key string) float64 {
+	switch v := p[key].(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case float64:
+		return v
+	}
+	return 0
+}
+
+func paginate[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return nil
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[offset:end]
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/visual-anomaly/api-go/internal/anomaly"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+func TestPersistedAnomaliesKeepNegativeScores(t *testing.T) {
+	var filters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Filter json.RawMessage }
+		json.NewDecoder(r.Body).Decode(&req)
+		filters = append(filters, string(req.Filter))
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/points/count"):
+			w.Write([]byte(`{"result": {"count": 1}}`))
+		case strings.HasSuffix(r.URL.Path, "/points/scroll"):
+			w.Write([]byte(`{"result": {"points": [{"id": 1, "payload": {"anomaly_score": -0.02}}], "next_page_offset": null}}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	q, _ := qdrant.NewClient(srv.URL, "")
+	h := &Handlers{qdrant: q}
+
+	hits, total, err := h.persistedAnomalies(context.Background(), anomalyQuery{limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(hits) != 1 || hits[0].score != -0.02 {
+		t.Errorf("got %d of %d, want the negative score", len(hits), total)
+	}
+	for _, f := range filters {
+		if strings.Contains(f, "range") || !strings.Contains(f, `"is_empty":{"key":"`+anomaly.ScoreField+`"}`) {
+			t.Errorf("filter without a threshold: %s", f)
+		}
+	}
+
+	filters = nil
+	threshold := -0.5
+	if _, _, err := h.persistedAnomalies(context.Background(), anomalyQuery{limit: 10, threshold: &threshold}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range filters {
+		if !strings.Contains(f, `"range":{"gte":-0.5}`) {
+			t.Errorf("filter with a threshold: %s", f)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+// maxBatchQueries bounds the number of queries of one batch search.
+const maxBatchQueries = 500
+
+type batchQuery struct {
+	ImageID        string                 `json:"image_id"`
+	TextQuery      string                 `json:"text_query"`
+	Limit          int                    `json:"limit"`
+	ScoreThreshold *float32               `json:"score_threshold"`
+	Filter         map[string]interface{} `json:"filter"`
+}
+
+// SearchBatch runs many similarity queries in a single Qdrant request. Each
+// query names an image_id or a text_query and may set its own limit, filter
+// and score_threshold. Results are returned in the order of the queries;
+// queries whose image does not exist, or whose image or text could not be
+// resolved, get an error entry instead.
+func (h *Handlers) SearchBatch(c *gin.Context) {
+	timer := prometheus.NewTimer(h.searchHist)
+	defer timer.ObserveDuration()
+
+	var req struct {
+		Queries        []batchQuery `json:"queries"`
+		IncludePayload bool         `json:"include_payload"`
+		ThumbnailSize  int          `json:"thumbnail_size"`
+		ExcludeSelf    bool         `json:"exclude_self"` // drop the query image from its own results
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Queries) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "queries required"})
+		return
+	}
+	if len(req.Queries) > maxBatchQueries {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at most " + strconv.Itoa(maxBatchQueries) + " queries per batch"})
+		return
+	}
+	for i := range req.Queries {
+		q := &req.Queries[i]
+		if (q.ImageID == "") == (q.TextQuery == "") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "query " + strconv.Itoa(i) + ": exactly one of image_id or text_query required"})
+			return
+		}
+		q.ImageID = normalizePointID(q.ImageID)
+		if q.Limit <= 0 {
+			q.Limit = 10
+		}
+		if q.Limit > 100 {
+			q.Limit = 100
+		}
+	}
+
+	ctx := c.Request.Context()
+
+	// Images are looked up and texts embedded for all queries at once. When
+	// that fails, only the queries concerned get an error entry.
+	var imageIDs, texts []string
+	seenText := map[string]bool{}
+	for _, q := range req.Queries {
+		if q.ImageID != "" {
+			imageIDs = append(imageIDs, q.ImageID)
+		} else if !seenText[q.TextQuery] {
+			seenText[q.TextQuery] = true
+			texts = append(texts, q.TextQuery)
+		}
+	}
+	var points map[string]*qdrant.Point
+	var lookupErr error
+	if len(imageIDs) > 0 {
+		if points, lookupErr = h.findPoints(ctx, imageIDs, true); lookupErr != nil {
+			slog.Error("Batch search: image lookup failed", "error", lookupErr)
+		}
+	}
+	vectors := make(map[string][]float32, len(texts))
+	if len(texts) > 0 {
+		embeddings, errs := h.getTextEmbeddings(texts)
+		for i, err := range errs {
+			if err != nil {
+				slog.Error("Batch search: text embedding failed", "error", err, "text", texts[i])
+				continue
+			}
+			vectors[texts[i]] = embeddings[i]
+		}
+	}
+
+	// Build one search per query that could be resolved; pending maps the
+	// position in the batch back to the query index.
+	var searches []qdrant.SearchRequest
+	var pending []int
+	entries := make([]gin.H, len(req.Queries))
+	for i, q := range req.Queries {
+		entry := gin.H{"index": i}
+		if q.ImageID != "" {
+			entry["image_id"] = q.ImageID
+		} else {
+			entry["text_query"] = q.TextQuery
+		}
+		entries[i] = entry
+
+		search := qdrant.SearchRequest{
+			Filter:      q.Filter,
+			Limit:       q.Limit,
+			WithPayload: true,
+			Threshold:   q.ScoreThreshold,
+		}
+		if q.ImageID != "" {
+			p := points[q.ImageID]
+			if lookupErr != nil {
+				entry["error"] = "image lookup failed"
+				continue
+			}
+			if p == nil {
+				entry["error"] = errImageNotFound.Error()
+				continue
+			}
+			search.Vector = p.Vector
+			if req.ExcludeSelf {
+				search.ExcludeIDs = []interface{}{p.ID}
+			}
+		} else {
+			vector, ok := vectors[q.TextQuery]
+			if !ok {
+				entry["error"] = errEmbedding.Error()
+				continue
+			}
+			search.Vector = vector
+		}
+		searches = append(searches, search)
+		pending = append(pending, i)
+	}
+
+	if len(searches) > 0 {
+		batch, err := h.qdrant.SearchBatch(ctx, searches)
+		if err != nil {
+			slog.Error("Batch search failed", "error", err, "queries", len(searches))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "search failed"})
+			return
+		}
+		for j, results := range batch {
+			response := h.renderSearchResults(ctx, results, req.IncludePayload, req.ThumbnailSize)
+			entries[pending[j]]["results"] = response
+			entries[pending[j]]["count"] = len(response)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": entries,
+		"count":   len(entries),
+	})
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+func TestSearchBatchReportsFailuresPerQuery(t *testing.T) {
+	// The embedding service embeds two texts per request and cannot embed
+	// "bad" ones; Qdrant knows image 1 only.
+	var embedRequests int
+	embed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		embedRequests++
+		var req struct {
+			Text  string
+			Texts []string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Text != "" {
+			req.Texts = []string{req.Text}
+		}
+		if len(req.Texts) > 2 {
+			req.Texts = req.Texts[:2]
+		}
+		var out [][]float32
+		for _, text := range req.Texts {
+			if strings.HasPrefix(text, "bad") {
+				http.Error(w, "cannot embed", http.StatusBadRequest)
+				return
+			}
+			out = append(out, []float32{1, 0})
+		}
+		if req.Text != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"embedding": out[0]})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"embeddings": out})
+	}))
+	defer embed.Close()
+	var searches int
+	db := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string][]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/points"):
+			w.Write([]byte(`{"result": [{"id": 1, "vector": [0, 1], "payload": {}}]}`))
+		case strings.HasSuffix(r.URL.Path, "/points/scroll"):
+			w.Write([]byte(`{"result": {"points": [], "next_page_offset": null}}`))
+		case strings.HasSuffix(r.URL.Path, "/points/search/batch"):
+			searches = len(req["searches"])
+			w.Write([]byte(`{"result": [` + strings.TrimSuffix(strings.Repeat(`[],`, searches), ",") + `]}`))
+		}
+	}))
+	defer db.Close()
+	q, _ := qdrant.NewClient(db.URL, "")
+	h := &Handlers{
+		qdrant:     q,
+		embedURL:   embed.URL,
+		httpClient: embed.Client(),
+		searchHist: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_search_seconds"}),
+	}
+
+	body := `{"queries": [
+		{"text_query": "a"}, {"text_query": "b"}, {"text_query": "a"},
+		{"image_id": "1"}, {"image_id": "2"},
+		{"text_query": "c"}, {"text_query": "bad"}, {"text_query": "d"}
+	]}`
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/search/batch", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	h.SearchBatch(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Results []struct {
+			Error   string        `json:"error"`
+			Results []interface{} `json:"results"`
+		} `json:"results"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	want := []string{"", "", "", "", errImageNotFound.Error(), "", errEmbedding.Error(), ""}
+	for i, e := range resp.Results {
+		if e.Error != want[i] {
+			t.Errorf("query %d: error %q, want %q", i, e.Error, want[i])
+		}
+	}
+	if searches != 6 {
+		t.Errorf("searched %d queries, want 6", searches)
+	}
+	// a and b; c and bad, failing; c alone; bad and d, failing; bad alone,
+	// failing; d
+	if embedRequests != 6 {
+		t.Errorf("made %d embedding requests, want 6", embedRequests)
+	}
+}
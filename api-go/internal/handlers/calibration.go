@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/visual-anomaly/api-go/internal/anomaly"
+	"github.com/visual-anomaly/api-go/internal/calibration"
+)
+
+// Calibration kinds.
+const (
+	calibrationAnomaly = "anomaly"
+	calibrationDedup   = "dedup"
+)
+
+// defaultDedupThreshold is the cosine similarity above which Deduplicate
+// groups images when the tenant has no calibrated threshold yet.
+const defaultDedupThreshold = 0.6
+
+type calibrationReport struct {
+	Kind      string              `json:"kind"`
+	Method    string              `json:"method,omitempty"`
+	Samples   int                 `json:"samples"`
+	Positives int                 `json:"positives"`
+	Curve     []calibration.Point `json:"curve"`
+	Best      *calibration.Point  `json:"best"`
+	Current   *storedCalibration  `json:"current"`
+}
+
+type storedCalibration struct {
+	Threshold float64   `json:"threshold"`
+	Precision float64   `json:"precision"`
+	Recall    float64   `json:"recall"`
+	F1        float64   `json:"f1"`
+	Samples   int       `json:"samples"`
+	Method    string    `json:"method,omitempty"`
+	FittedAt  time.Time `json:"fitted_at"`
+}
+
+// GetCalibration returns the precision/recall curves of the anomaly and dedup
+// thresholds on the caller's labelled feedback, next to the thresholds in use.
+func (h *Handlers) GetCalibration(c *gin.Context) {
+	h.calibrate(c, false)
+}
+
+// FitCalibration fits the F1-maximizing thresholds on the caller's feedback
+// and stores them for use by GetAnomalies and Deduplicate.
+func (h *Handlers) FitCalibration(c *gin.Context) {
+	h.calibrate(c, true)
+}
+
+func (h *Handlers) calibrate(c *gin.Context, store bool) {
+	tenant := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+
+	anomalySamples, err := h.anomalyCalibrationSamples(ctx, tenant)
+	if err != nil {
+		slog.Error("Calibration: loading anomaly labels failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load feedback"})
+		return
+	}
+	dedupSamples, err := h.dedupCalibrationSamples(ctx, tenant)
+	if err != nil {
+		slog.Error("Calibration: loading duplicate labels failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load feedback"})
+		return
+	}
+
+	reports := []*calibrationReport{
+		buildCalibrationReport(calibrationAnomaly, string(h.anomalyJob.Method()), anomalySamples),
+		buildCalibrationReport(calibrationDedup, "", dedupSamples),
+	}
+
+	for _, r := range reports {
+		if store && r.Best != nil {
+			if err := h.storeCalibration(ctx, tenant, r); err != nil {
+				slog.Error("Calibration: storing threshold failed", "error", err, "kind", r.Kind)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store calibration"})
+				return
+			}
+		}
+		r.Current, err = h.loadCalibration(ctx, tenant, r.Kind)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load calibration"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tenant":  tenant,
+		"anomaly": reports[0],
+		"dedup":   reports[1],
+	})
+}
+
+func buildCalibrationReport(kind, method string, samples []calibration.Sample) *calibrationReport {
+	r := &calibrationReport{Kind: kind, Method: method, Samples: len(samples), Curve: calibration.Curve(samples)}
+	for _, s := range samples {
+		if s.Positive {
+			r.Positives++
+		}
+	}
+	if r.Curve == nil {
+		r.Curve = []calibration.Point{}
+	}
+	if best, ok := calibration.Best(r.Curve); ok {
+		r.Best = &best
+	}
+	return r
+}
+
+// anomalyCalibrationSamples pairs the latest anomaly/normal label of each
+// image with its persisted anomaly score.
+func (h *Handlers) anomalyCalibrationSamples(ctx context.Context, tenant string) ([]calibration.Sample, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT DISTINCT ON (image_id) image_id, action
+		FROM feedback
+		WHERE user_id = $1 AND action IN ('anomaly', 'normal')
+		ORDER BY image_id, created_at DESC
+	`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type label struct{ imageID, action string }
+	var labels []label
+	var ids []string
+	for rows.Next() {
+		var l label
+		if err := rows.Scan(&l.imageID, &l.action); err != nil {
+			return nil, err
+		}
+		labels = append(labels, l)
+		ids = append(ids, l.imageID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	points, err := h.findPoints(ctx, ids, false)
+	if err != nil {
+		return nil, err
+	}
+	var samples []calibration.Sample
+	for _, l := range labels {
+		p := points[l.imageID]
+		if p == nil {
+			continue
+		}
+		if _, ok := p.Payload[anomaly.ScoreField]; !ok {
+			continue // not scored yet
+		}
+		samples = append(samples, calibration.Sample{
+			Score:    payloadFloat(p.Payload, anomaly.ScoreField),
+			Positive: l.action == "anomaly",
+		})
+	}
+	return samples, nil
+}
+
+// dedupCalibrationSamples pairs the latest duplicate/not_duplicate label of
+// each image pair with the cosine similarity of the two images.
+func (h *Handlers) dedupCalibrationSamples(ctx context.Context, tenant string) ([]calibration.Sample, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT DISTINCT ON (image_id, related_image_id) image_id, related_image_id, action
+		FROM feedback
+		WHERE user_id = $1 AND action IN ('duplicate', 'not_duplicate')
+			AND related_image_id IS NOT NULL AND related_image_id <> ''
+		ORDER BY image_id, related_image_id, created_at DESC
+	`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type label struct{ imageID, relatedID, action string }
+	var labels []label
+	var ids []string
+	for rows.Next() {
+		var l label
+		if err := rows.Scan(&l.imageID, &l.relatedID, &l.action); err != nil {
+			return nil, err
+		}
+		labels = append(labels, l)
+		ids = append(ids, l.imageID, l.relatedID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	points, err := h.findPoints(ctx, ids, true)
+	if err != nil {
+		return nil, err
+	}
+	var samples []calibration.Sample
+	for _, l := range labels {
+		a, b := points[l.imageID], points[l.relatedID]
+		if a == nil || b == nil {
+			continue
+		}
+		samples = append(samples, calibration.Sample{
+			Score:    1 - anomaly.CosineDistance(a.Vector, b.Vector),
+			Positive: l.action == "duplicate",
+		})
+	}
+	return samples, nil
+}
+
+func (h *Handlers) storeCalibration(ctx context.Context, tenant string, r *calibrationReport) error {
+	_, err := h.db.ExecContext(ctx, `
+		INSERT INTO calibrations (tenant_id, kind, threshold, precision_score, recall_score, f1_score, samples, method, fitted_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (tenant_id, kind) DO UPDATE SET
+			threshold = EXCLUDED.threshold,
+			precision_score = EXCLUDED.precision_score,
+			recall_score = EXCLUDED.recall_score,
+			f1_score = EXCLUDED.f1_score,
+			samples = EXCLUDED.samples,
+			method = EXCLUDED.method,
+			fitted_at = EXCLUDED.fitted_at
+	`, tenant, r.Kind, r.Best.Threshold, r.Best.Precision, r.Best.Recall, r.Best.F1, r.Samples, r.Method, time.Now().UTC())
+	return err
+}
+
+func (h *Handlers) loadCalibration(ctx context.Context, tenant, kind string) (*storedCalibration, error) {
+	if h.db == nil {
+		return nil, nil
+	}
+	var sc storedCalibration
+	err := h.db.QueryRowContext(ctx, `
+		SELECT threshold, precision_score, recall_score, f1_score, samples, method, fitted_at
+		FROM calibrations WHERE tenant_id = $1 AND kind = $2
+	`, tenant, kind).Scan(&sc.Threshold, &sc.Precision, &sc.Recall, &sc.F1, &sc.Samples, &sc.Method, &sc.FittedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// calibratedThreshold returns the tenant's fitted threshold of the given
+// kind. Anomaly thresholds fitted for another scoring method are ignored.
+func (h *Handlers) calibratedThreshold(ctx context.Context, tenant, kind string) (float64, bool) {
+	sc, err := h.loadCalibration(ctx, tenant, kind)
+	if err != nil {
+		slog.Error("Failed to load calibration", "error", err, "kind", kind)
+		return 0, false
+	}
+	if sc == nil || (kind == calibrationAnomaly && sc.Method != string(h.anomalyJob.Method())) {
+		return 0, false
+	}
+	return sc.Threshold, true
+}
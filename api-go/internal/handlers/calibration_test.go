@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+func TestFindPointsMakesOneRequestPerKindOfID(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/points"):
+			if ids := req["ids"].([]interface{}); len(ids) != 2 {
+				t.Errorf("retrieve got ids %v", ids)
+			}
+			w.Write([]byte(`{"result": [{"id": 1, "payload": {"image_id": "A"}}]}`))
+		case strings.HasSuffix(r.URL.Path, "/points/scroll"):
+			match := req["filter"].(map[string]interface{})["must"].([]interface{})[0].(map[string]interface{})["match"]
+			if any := match.(map[string]interface{})["any"].([]interface{}); len(any) != 2 {
+				t.Errorf("scroll got image_ids %v", any)
+			}
+			w.Write([]byte(`{"result": {"points": [{"id": 3, "payload": {"image_id": "C"}}], "next_page_offset": null}}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	q, _ := qdrant.NewClient(srv.URL, "")
+	h := &Handlers{qdrant: q}
+
+	// 2 is not a point ID, so it is looked up as an image_id with C
+	found, err := h.findPoints(context.Background(), []string{"1", "2", "C", "C", "1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("made %d requests, want 2: %v", len(paths), paths)
+	}
+	if found["1"] == nil || found["C"] == nil || found["2"] != nil || len(found) != 2 {
+		t.Errorf("found %v", found)
+	}
+}
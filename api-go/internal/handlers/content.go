@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+	"github.com/visual-anomaly/api-go/internal/storage"
+)
+
+// Preview and thumbnail URLs point at the API rather than at the object
+// store, so they work behind any ingress. An <img> cannot send a bearer
+// token, so the URLs carry an expiry and an HMAC signature instead; a
+// bearer token is accepted too.
+
+// contentURL returns the signed URL of an image's original ("content") or
+// of its size px thumbnail ("thumbnail"). Expiry is rounded up to a whole
+// TTL so that repeated listings return the same URL and browsers can cache
+// the image.
+func (h *Handlers) contentURL(id interface{}, variant string, size int) string {
+	imageID := fmt.Sprint(id)
+	ttl := int64(h.contentURLTTL / time.Second)
+	expires := (time.Now().Unix()/ttl + 2) * ttl
+	params := url.Values{}
+	if variant == "thumbnail" {
+		params.Set("size", strconv.Itoa(size))
+	}
+	params.Set("expires", strconv.FormatInt(expires, 10))
+	params.Set("signature", h.signContent(imageID, variant, params.Get("size"), params.Get("expires")))
+	return fmt.Sprintf("%s/images/%s/%s?%s", h.publicURL, url.PathEscape(imageID), variant, params.Encode())
+}
+
+func (h *Handlers) signContent(fields ...string) string {
+	m := hmac.New(sha256.New, h.contentSecret)
+	m.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// authorizeContent checks a content request: either its URL is signed for
+// this image and variant, or it has a bearer token of the image's owner.
+// On failure it writes the error response.
+func (h *Handlers) authorizeContent(c *gin.Context, imageID, variant string, point *qdrant.Point) bool {
+	if sig := c.Query("signature"); sig != "" {
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		want := h.signContent(imageID, variant, c.Query("size"), c.Query("expires"))
+		if err != nil || time.Now().Unix() > expires || !hmac.Equal([]byte(sig), []byte(want)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "invalid or expired signature", "code": "INVALID_SIGNATURE"})
+			return false
+		}
+		return true
+	}
+
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "authorization header or signature required"})
+		return false
+	}
+	claims, err := h.auth.ValidateToken(token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return false
+	}
+	if owner, ok := point.Payload["owner_user_id"].(string); ok && owner != claims.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+		return false
+	}
+	return true
+}
+
+// GetImageContent streams the original of an image.
+func (h *Handlers) GetImageContent(c *gin.Context) {
+	imageID := c.Param("id")
+	point, err := h.findPoint(c.Request.Context(), imageID, false)
+	if err != nil || point == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "image not found"})
+		return
+	}
+	if !h.authorizeContent(c, imageID, "content", point) {
+		return
+	}
+	key, _ := point.Payload["key"].(string)
+	if key == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "image not found in storage"})
+		return
+	}
+	h.serveObject(c, key)
+}
+
+// GetImageThumbnail streams the thumbnail of the configured size nearest to
+// ?size=, generating missing thumbnails first. When generation fails the
+// original is streamed instead, uncached, so that a later successful
+// generation is picked up.
+func (h *Handlers) GetImageThumbnail(c *gin.Context) {
+	imageID := c.Param("id")
+	point, err := h.findPoint(c.Request.Context(), imageID, false)
+	if err != nil || point == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "image not found"})
+		return
+	}
+	if !h.authorizeContent(c, imageID, "thumbnail", point) {
+		return
+	}
+	size := h.thumbnailSize(queryInt(c, "size", 0, 0, 4096))
+	key := thumbnailKey(point.Payload, size)
+	if key == "" {
+		src := thumbnailSource{ID: point.ID, Payload: point.Payload}
+		key = thumbnailKey(h.ensureThumbnails(c.Request.Context(), src), size)
+	}
+	if key == "" {
+		key, _ = point.Payload["key"].(string)
+		c.Header("Cache-Control", "no-cache")
+	}
+	if key == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "image not found in storage"})
+		return
+	}
+	h.serveObject(c, key)
+}
+
+// serveObject streams a stored object. Objects that can seek, as both
+// backends' can, go through http.ServeContent for Range, If-Range and
+// If-Modified-Since; ETag and If-None-Match are handled either way.
+func (h *Handlers) serveObject(c *gin.Context, key string) {
+	r, info, err := h.storage.OpenReader(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "image not found in storage"})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to open object", "error", err, "key", key)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read image"})
+		return
+	}
+	defer r.Close()
+
+	etag := strconv.Quote(info.ETag)
+	c.Header("ETag", etag)
+	c.Header("Content-Type", info.ContentType)
+	if c.Writer.Header().Get("Cache-Control") == "" {
+		c.Header("Cache-Control", "private, max-age="+strconv.Itoa(int(h.contentURLTTL/time.Second)))
+	}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, "", info.LastModified, rs)
+		return
+	}
+
+	for _, t := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		if t = strings.TrimPrefix(strings.TrimSpace(t), "W/"); t == etag || t == "*" {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.DataFromReader(http.StatusOK, info.Size, info.ContentType, r, nil)
+}
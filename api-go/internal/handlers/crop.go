@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+
+	"github.com/visual-anomaly/api-go/internal/imaging"
+)
+
+// cropPreviewSize is the longest side of the crop preview in the response.
+const cropPreviewSize = 256
+
+// boundingBox is a region of interest of a query image. Units are "px" or
+// "normalized" (fractions of the image size); when omitted, boxes whose
+// values are all at most 1 are taken as normalized.
+type boundingBox struct {
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	W     float64 `json:"w"`
+	H     float64 `json:"h"`
+	Units string  `json:"units"`
+}
+
+func (b *boundingBox) validate() error {
+	if b.Units == "" {
+		b.Units = "px"
+		if b.X <= 1 && b.Y <= 1 && b.W <= 1 && b.H <= 1 {
+			b.Units = "normalized"
+		}
+	}
+	if b.Units != "px" && b.Units != "normalized" {
+		return fmt.Errorf("%w: bbox units must be px or normalized", errBadQuery)
+	}
+	if b.X < 0 || b.Y < 0 || b.W <= 0 || b.H <= 0 {
+		return fmt.Errorf("%w: bbox needs x, y >= 0 and w, h > 0", errBadQuery)
+	}
+	return nil
+}
+
+// rect converts the box to pixels of bounds, clipped to the image.
+func (b *boundingBox) rect(bounds image.Rectangle) image.Rectangle {
+	x, y, w, h := b.X, b.Y, b.W, b.H
+	if b.Units == "normalized" {
+		x, w = x*float64(bounds.Dx()), w*float64(bounds.Dx())
+		y, h = y*float64(bounds.Dy()), h*float64(bounds.Dy())
+	}
+	r := image.Rect(int(x), int(y), int(x+w+0.5), int(y+h+0.5))
+	return r.Add(bounds.Min).Intersect(bounds)
+}
+
+// cropQueryInput replaces the image of in with the region of interest: the
+// crop is embedded instead of the whole image. It returns the crop geometry
+// and a small JPEG preview of the crop for the response.
+func (h *Handlers) cropQueryInput(ctx context.Context, in *queryInput, box *boundingBox) (map[string]interface{}, error) {
+	var img image.Image
+	var err error
+	if in.upload != nil {
+		if err := h.checkImage(in.upload); err != nil {
+			return nil, queryImageError(err)
+		}
+		img, _, err = imaging.Decode(in.upload)
+	} else {
+		p, ferr := h.findPoint(ctx, normalizePointID(in.ImageID), false)
+		if ferr != nil || p == nil {
+			return nil, fmt.Errorf("%w: %s", errImageNotFound, in.ImageID)
+		}
+		key, _ := p.Payload["key"].(string)
+		if key == "" {
+			return nil, fmt.Errorf("%w: %s has no stored image", errImageNotFound, in.ImageID)
+		}
+		img, err = h.decodeStored(ctx, key)
+		if isLimitError(err) {
+			return nil, err
+		}
+		if err != nil && !isDecodeError(err) {
+			return nil, fmt.Errorf("download %s: %w", key, err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decode image for bbox: %v", errBadQuery, err)
+	}
+	bounds := img.Bounds()
+	r := box.rect(bounds)
+	if r.Empty() {
+		return nil, fmt.Errorf("%w: bbox lies outside the %dx%d image", errBadQuery, bounds.Dx(), bounds.Dy())
+	}
+
+	crop := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(crop, crop.Bounds(), img, r.Min, draw.Src)
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, crop, &jpeg.Options{Quality: 95}); err != nil {
+		return nil, fmt.Errorf("encode crop: %w", err)
+	}
+	in.upload = buf.Bytes()
+
+	preview := new(bytes.Buffer)
+	if err := jpeg.Encode(preview, imaging.Fit(crop, cropPreviewSize), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, fmt.Errorf("encode crop preview: %w", err)
+	}
+
+	return map[string]interface{}{
+		"x":            r.Min.X - bounds.Min.X,
+		"y":            r.Min.Y - bounds.Min.Y,
+		"w":            r.Dx(),
+		"h":            r.Dy(),
+		"image_width":  bounds.Dx(),
+		"image_height": bounds.Dy(),
+		"preview":      "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(preview.Bytes()),
+	}, nil
+}
@@ -0,0 +1,622 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/corona10/goimagehash"
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
+	"github.com/visual-anomaly/api-go/internal/anomaly"
+	"github.com/visual-anomaly/api-go/internal/imaging"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+	"github.com/visual-anomaly/api-go/internal/storage"
+	"github.com/visual-anomaly/api-go/internal/webhook"
+)
+
+var (
+	errInvalidImage  = errors.New("invalid image format")
+	errStoreVector   = errors.New("failed to store in vector database")
+	errStripGPS      = errors.New("failed to store image without GPS data")
+	errNotStreamable = errors.New("image must be read into memory")
+)
+
+// streamableFormats are decoded for ingest straight from storage; their
+// headers are at the start of the file.
+var streamableFormats = map[string]bool{"jpeg": true, "png": true, "webp": true, "bmp": true}
+
+// ingestInput is an image that is already in object storage at Key, with
+// its bytes in Data, or nil to read them from storage.
+type ingestInput struct {
+	UserID      string
+	Bucket      string
+	Key         string
+	Data        []byte
+	ContentType string // as declared by the uploader, checked against the content
+	Tags        []string
+	Album       string
+	Source      string // "upload" or "url"
+	SourceURL   string
+	Checked     bool // checkUpload already passed
+}
+
+type ingestResult struct {
+	ImageID string `json:"image_id"`
+	SHA256  string `json:"sha256"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Format  string `json:"format"`
+}
+
+// decodedImage is an image checked, hashed and decoded for ingest.
+type decodedImage struct {
+	img    image.Image // upright as displayed
+	format string
+	meta   imaging.Metadata
+	sha256 string
+	size   int64
+	// data is the file when it was read into memory, nil when streamed
+	data []byte
+}
+
+// ingest decodes, hashes and embeds an image and stores it as a Qdrant point.
+// It is shared by every way images enter the system.
+func (h *Handlers) ingest(ctx context.Context, in ingestInput) (*ingestResult, error) {
+	d, err := h.decodeForIngest(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	img, format, meta, sha256Hash := d.img, d.format, d.meta, d.sha256
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	// Compute perceptual hash
+	hash, err := goimagehash.PerceptionHash(img)
+	if err != nil {
+		slog.Error("Failed to compute phash", "error", err)
+	}
+	phash := hash.ToString()
+
+	// Get embedding from embedding service
+	embedding, frameCount, err := h.embedDecoded(ctx, in.Key, d)
+	if err != nil {
+		return nil, err
+	}
+
+	// Debug: Log embedding info
+	slog.Info("Got embedding", "length", len(embedding), "sample", embedding[:5])
+
+	// Generate image ID from key
+	imageID := ulid.Make().String()
+
+	tags := in.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	// Create Qdrant point with integer ID
+	point := qdrant.Point{
+		ID:     time.Now().UnixNano(),
+		Vector: embedding,
+		Payload: qdrant.Payload{
+			"image_id":      imageID,
+			"bucket":        in.Bucket,
+			"key":           in.Key,
+			"sha256":        sha256Hash,
+			"phash":         phash,
+			"width":         width,
+			"height":        height,
+			"format":        format,
+			"source":        in.Source,
+			"tags":          tags,
+			"model_name":    "ViT-B-32",
+			"model_version": "openai",
+			"owner_user_id": in.UserID,
+		},
+	}
+
+	if in.Album != "" {
+		point.Payload["album"] = in.Album
+	}
+	if in.SourceURL != "" {
+		point.Payload["source_url"] = in.SourceURL
+	}
+	if frameCount > 0 {
+		point.Payload["frame_count"] = frameCount
+	}
+	for k, v := range metadataPayload(meta) {
+		point.Payload[k] = v
+	}
+	thumbnails := h.storeThumbnails(ctx, in.UserID, imageID, img)
+	for k, v := range thumbnails {
+		point.Payload[k] = v
+	}
+
+	// Stamped last, so that saved search sweeps, which look back
+	// savedSearchOverlap from their previous run, see the point.
+	point.Payload["created_at"] = time.Now().UTC().Format(time.RFC3339)
+
+	// Debug: Log point info before upsert
+	slog.Info("About to upsert point", "id", point.ID, "vector_length", len(point.Vector))
+
+	// Store in Qdrant
+	if err := h.qdrant.UpsertPoint(ctx, point); err != nil {
+		slog.Error("Failed to upsert point", "error", err)
+		h.deleteThumbnails(ctx, thumbnails)
+		return nil, fmt.Errorf("%w: %v", errStoreVector, err)
+	}
+
+	// Debug: Log successful upsert
+	slog.Info("Successfully upserted point", "id", point.ID)
+
+	h.anomalyJob.Notify(anomaly.Change{ID: point.ID, Vector: embedding})
+	h.notifySavedSearches()
+	h.webhooks.Emit(ctx, in.UserID, webhook.EventImageIngested, gin.H{
+		"image_id":   imageID,
+		"sha256":     sha256Hash,
+		"width":      width,
+		"height":     height,
+		"format":     format,
+		"source":     in.Source,
+		"source_url": in.SourceURL,
+		"tags":       tags,
+		"album":      in.Album,
+	})
+	h.emitDuplicates(ctx, in.UserID, imageID, point.ID, sha256Hash, embedding)
+
+	// Update metrics
+	h.uploadCounter.Inc()
+
+	// Log to database if available
+	if h.db != nil {
+		_, err = h.db.ExecContext(ctx, `
+			INSERT INTO image_uploads (image_id, user_id, sha256, phash, width, height, format, size_bytes, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`, imageID, in.UserID, sha256Hash, phash, width, height, format, d.size, time.Now().UTC())
+		if err != nil {
+			slog.Error("Failed to log upload", "error", err)
+		}
+	}
+
+	return &ingestResult{
+		ImageID: imageID,
+		SHA256:  sha256Hash,
+		Width:   width,
+		Height:  height,
+		Format:  format,
+	}, nil
+}
+
+// decodeForIngest checks, hashes and decodes the image of in. Without
+// in.Data, images in streamableFormats are streamed from storage: the file
+// is hashed as it is decoded and never held in memory, only the decoded
+// image is. Other formats, and files whose GPS data is stripped, are read
+// into memory first.
+func (h *Handlers) decodeForIngest(ctx context.Context, in ingestInput) (*decodedImage, error) {
+	if in.Data == nil {
+		d, err := h.decodeStreamed(ctx, in)
+		if !errors.Is(err, errNotStreamable) {
+			return d, err
+		}
+		if in.Data, err = h.storage.DownloadFile(ctx, in.Key); err != nil {
+			return nil, fmt.Errorf("download %s: %w", in.Key, err)
+		}
+	}
+	return h.decodeBuffered(ctx, in)
+}
+
+// decodeStreamed decodes an image straight from storage, or returns
+// errNotStreamable.
+func (h *Handlers) decodeStreamed(ctx context.Context, in ingestInput) (*decodedImage, error) {
+	object, info, err := h.storage.OpenReader(ctx, in.Key)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", in.Key, err)
+	}
+	defer object.Close()
+
+	head, r := imaging.Peek(object)
+	meta := imaging.ReadMetadata(head)
+	if !streamableFormats[imaging.Sniff(head)] || (h.stripGPS && meta.HasGPS) {
+		return nil, errNotStreamable
+	}
+	// An image header past the peeked bytes needs the whole file
+	if _, _, err := imaging.DecodeConfig(head); err != nil && int64(len(head)) < info.Size {
+		return nil, errNotStreamable
+	}
+	if !in.Checked {
+		if err := h.checkUpload(ctx, in.UserID, head, info.Size, in.ContentType); err != nil {
+			return nil, err
+		}
+	}
+
+	hasher := sha256.New()
+	img, format, err := imaging.DecodeFrom(io.TeeReader(r, hasher), head)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	// Hash whatever follows the image data
+	if _, err := io.Copy(hasher, r); err != nil {
+		return nil, fmt.Errorf("read %s: %w", in.Key, err)
+	}
+	return &decodedImage{
+		img:    img,
+		format: format,
+		meta:   meta,
+		sha256: hex.EncodeToString(hasher.Sum(nil)),
+		size:   info.Size,
+	}, nil
+}
+
+// decodeBuffered decodes in.Data, first blanking out its GPS data when
+// STRIP_GPS is set.
+func (h *Handlers) decodeBuffered(ctx context.Context, in ingestInput) (*decodedImage, error) {
+	if !in.Checked {
+		if err := h.checkUpload(ctx, in.UserID, in.Data, int64(len(in.Data)), in.ContentType); err != nil {
+			return nil, err
+		}
+	}
+
+	meta := imaging.ReadMetadata(in.Data)
+
+	// Replace the stored original before anything is derived from it
+	if h.stripGPS && meta.HasGPS {
+		if stripped, ok := imaging.StripGPS(in.Data); ok {
+			if err := h.storage.UploadFile(ctx, in.Key, stripped, imaging.ContentType(imaging.Sniff(stripped))); err != nil {
+				return nil, fmt.Errorf("%w: %v", errStripGPS, err)
+			}
+			in.Data = stripped
+		}
+		meta.HasGPS = false
+	}
+
+	// Decode image to get dimensions, upright as displayed
+	img, format, err := imaging.Decode(in.Data)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return &decodedImage{
+		img:    img,
+		format: format,
+		meta:   meta,
+		sha256: storage.ComputeSHA256(in.Data),
+		size:   int64(len(in.Data)),
+		data:   in.Data,
+	}, nil
+}
+
+// embedDecoded embeds an image decoded for ingest. A streamed image that
+// can be sent as it is is streamed again from storage at key to the
+// embedding service.
+func (h *Handlers) embedDecoded(ctx context.Context, key string, d *decodedImage) ([]float32, int, error) {
+	if d.data != nil {
+		return h.embedImage(d.data, d.img, d.format, d.meta.Orientation)
+	}
+	if imaging.Portable(d.format) && d.meta.Orientation == 1 {
+		object, info, err := h.storage.OpenReader(ctx, key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("open %s: %w", key, err)
+		}
+		defer object.Close()
+		embedding, err := h.getImageEmbeddingStream(object, info.Size)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errEmbedding, err)
+		}
+		return embedding, 0, nil
+	}
+	embedData, err := imaging.PortableBytes(d.img)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	embedding, err := h.getImageEmbedding(embedData)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errEmbedding, err)
+	}
+	return embedding, 0, nil
+}
+
+// decodeStored streams a stored image through the decoder, so that only
+// the decoded image is held in memory. Decoding failures wrap
+// errInvalidImage or are an *imaging.UnsupportedFormatError; images over
+// the size or pixel limits fail with errFileTooLarge or errTooManyPixels.
+func (h *Handlers) decodeStored(ctx context.Context, key string) (image.Image, error) {
+	object, _, err := h.storage.OpenReader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	head, r := imaging.Peek(object)
+	return h.decodeBounded(r, head)
+}
+
+// embedStored embeds a stored image. Upright JPEG, PNG and WebP files are
+// streamed from storage to the embedding service without being decoded;
+// others are decoded as on ingest.
+func (h *Handlers) embedStored(ctx context.Context, key string) ([]float32, error) {
+	object, info, err := h.storage.OpenReader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	head, r := imaging.Peek(object)
+	format := imaging.Sniff(head)
+	switch {
+	case format == "gif":
+		// Frames are sampled from the whole file
+		data, err := h.readLimited(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.checkPixels(data); err != nil {
+			return nil, err
+		}
+		img, format, err := imaging.Decode(data)
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		embedding, _, err := h.embedImage(data, img, format, 1)
+		return embedding, err
+	case imaging.Portable(format) && imaging.ReadMetadata(head).Orientation == 1:
+		embedding, err := h.getImageEmbeddingStream(r, info.Size)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errEmbedding, err)
+		}
+		return embedding, nil
+	}
+	img, err := h.decodeBounded(r, head)
+	if err != nil {
+		return nil, err
+	}
+	embedData, err := imaging.PortableBytes(img)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	embedding, err := h.getImageEmbedding(embedData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errEmbedding, err)
+	}
+	return embedding, nil
+}
+
+// isDecodeError reports whether err is an image decoding failure rather
+// than a storage one.
+func isDecodeError(err error) bool {
+	var unsupported *imaging.UnsupportedFormatError
+	return errors.Is(err, errInvalidImage) || errors.As(err, &unsupported)
+}
+
+// decodeError maps an image decoding failure to errInvalidImage, keeping an
+// *imaging.UnsupportedFormatError as is since it names the format.
+func decodeError(err error) error {
+	var unsupported *imaging.UnsupportedFormatError
+	if errors.As(err, &unsupported) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errInvalidImage, err)
+}
+
+// embedImage embeds a decoded image. The embedding service ignores EXIF
+// orientation and reads only common formats, so it is sent the upright
+// image, re-encoded when needed. Animated GIFs are embedded as the mean of
+// up to h.gifFrames frames spread over the animation; frameCount is the
+// number of frames of a GIF and 0 for other formats.
+func (h *Handlers) embedImage(data []byte, img image.Image, format string, orientation int) (embedding []float32, frameCount int, err error) {
+	frames := []image.Image{img}
+	if format == "gif" {
+		frames, frameCount, err = imaging.GIFFrames(data, h.gifFrames)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errInvalidImage, err)
+		}
+	}
+
+	if len(frames) == 1 {
+		embedData, err := imaging.UprightBytes(data, img, format, orientation)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errInvalidImage, err)
+		}
+		embedding, err = h.getImageEmbedding(embedData)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errEmbedding, err)
+		}
+		return embedding, frameCount, nil
+	}
+
+	inputs := make([]queryInput, len(frames))
+	for i, f := range frames {
+		frameData, err := imaging.PortableBytes(f)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errInvalidImage, err)
+		}
+		if inputs[i].vector, err = h.getImageEmbedding(frameData); err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errEmbedding, err)
+		}
+	}
+	return unitVector(composeWeighted(inputs)), frameCount, nil
+}
+
+// unitVector scales v to unit length.
+func unitVector(v []float32) []float32 {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	if norm == 0 {
+		return v
+	}
+	scale := 1 / math.Sqrt(norm)
+	for i := range v {
+		v[i] = float32(float64(v[i]) * scale)
+	}
+	return v
+}
+
+func respondIngestError(c *gin.Context, err error) {
+	var unsupported *imaging.UnsupportedFormatError
+	switch {
+	case errors.As(err, &unsupported):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":             unsupported.Error(),
+			"code":              "UNSUPPORTED_FORMAT",
+			"format":            unsupported.Format,
+			"supported_formats": imaging.SupportedFormats(),
+		})
+	case isLimitError(err):
+		respondLimitError(c, err)
+	case errors.Is(err, errContentMismatch):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error(), "code": "CONTENT_TYPE_MISMATCH"})
+	case errors.Is(err, errQuotaExceeded):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "code": "QUOTA_EXCEEDED"})
+	case errors.Is(err, errQuotaUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "code": "QUOTA_UNAVAILABLE"})
+	case errors.Is(err, errInvalidImage):
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidImage.Error(), "code": "INVALID_IMAGE"})
+	case errors.Is(err, errEmbedding):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": errEmbedding.Error(), "code": "EMBEDDING_FAILED"})
+	case errors.Is(err, errStoreVector):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": errStoreVector.Error(), "code": "VECTOR_STORE_FAILED"})
+	case errors.Is(err, errStripGPS):
+		slog.Error("Ingest failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": errStripGPS.Error(), "code": "STORAGE_FAILED"})
+	default:
+		slog.Error("Ingest failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ingest failed", "code": "INGEST_FAILED"})
+	}
+}
+
+// IngestFromURL fetches an image from an external URL, stores it in object
+// storage and ingests it like an upload.
+func (h *Handlers) IngestFromURL(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		URL   string   `json:"url" binding:"required"`
+		Tags  []string `json:"tags"`
+		Album string   `json:"album"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	data, contentType, err := h.fetcher.Image(ctx, req.URL)
+	if err != nil {
+		slog.Warn("Fetching image URL failed", "error", err, "url", req.URL)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to fetch image: " + err.Error()})
+		return
+	}
+	// Reject content over the limits before it reaches storage.
+	if err := h.checkUpload(ctx, userID, data, int64(len(data)), ""); err != nil {
+		respondIngestError(c, err)
+		return
+	}
+
+	key := storage.GenerateImageKey(userID, ulid.Make().String())
+	if err := h.storage.UploadFile(ctx, key, data, contentType); err != nil {
+		slog.Error("Storing fetched image failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store image"})
+		return
+	}
+
+	result, err := h.ingest(ctx, ingestInput{
+		UserID:    userID,
+		Bucket:    h.storage.Bucket(),
+		Key:       key,
+		Data:      data,
+		Tags:      req.Tags,
+		Album:     req.Album,
+		Source:    "url",
+		SourceURL: req.URL,
+		Checked:   true,
+	})
+	if err != nil {
+		_ = h.storage.DeleteFile(ctx, key)
+		respondIngestError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// duplicateEventLimit caps the duplicates listed in one duplicate.detected
+// event.
+const duplicateEventLimit = 10
+
+// emitDuplicates sends duplicate.detected when a freshly ingested image is an
+// exact (same SHA-256) or near duplicate of another image of the owner. Near
+// duplicates use the same threshold as Deduplicate.
+func (h *Handlers) emitDuplicates(ctx context.Context, owner, imageID string, pointID interface{}, sha256Hash string, embedding []float32) {
+	if !h.webhooks.Subscribed(ctx, owner, webhook.EventDuplicateDetected) {
+		return
+	}
+
+	threshold := float32(defaultDedupThreshold)
+	if t, ok := h.calibratedThreshold(ctx, owner, calibrationDedup); ok {
+		threshold = float32(t)
+	}
+	results, err := h.qdrant.Search(ctx, qdrant.SearchRequest{
+		Vector:      embedding,
+		Filter:      map[string]interface{}{"owner_user_id": owner},
+		Limit:       duplicateEventLimit,
+		WithPayload: true,
+		Threshold:   &threshold,
+		ExcludeIDs:  []interface{}{pointID},
+	})
+	if err != nil {
+		slog.Error("Duplicate check failed", "error", err, "image_id", imageID)
+		return
+	}
+
+	duplicates := make([]gin.H, 0, len(results))
+	for _, r := range results {
+		dupID, _ := r.Payload["image_id"].(string)
+		dupSHA, _ := r.Payload["sha256"].(string)
+		duplicates = append(duplicates, gin.H{
+			"image_id": dupID,
+			"score":    r.Score,
+			"exact":    dupSHA == sha256Hash,
+		})
+	}
+	if len(duplicates) == 0 {
+		return
+	}
+	h.webhooks.Emit(ctx, owner, webhook.EventDuplicateDetected, gin.H{
+		"image_id":   imageID,
+		"threshold":  threshold,
+		"duplicates": duplicates,
+	})
+}
+
+// metadataPayload returns the payload fields for the EXIF/XMP metadata of
+// an image; unknown fields are left out.
+func metadataPayload(m imaging.Metadata) map[string]interface{} {
+	fields := map[string]interface{}{"orientation": m.Orientation}
+	if m.Make != "" {
+		fields["camera_make"] = m.Make
+	}
+	if m.Model != "" {
+		fields["camera_model"] = m.Model
+	}
+	if m.Lens != "" {
+		fields["lens_model"] = m.Lens
+	}
+	if !m.CapturedAt.IsZero() {
+		fields["captured_at"] = m.CapturedAt.Format(time.RFC3339)
+	}
+	if m.HasGPS {
+		fields["location"] = map[string]float64{"lat": m.Latitude, "lon": m.Longitude}
+	}
+	return fields
+}
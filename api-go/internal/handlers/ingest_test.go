@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/visual-anomaly/api-go/internal/storage"
+)
+
+func newTestStore(t *testing.T) *storage.LocalStore {
+	t.Helper()
+	s, err := storage.NewLocalStore(t.TempDir(), "/api/storage", []byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// noisePNG encodes a w x h opaque image of random pixels, which does not
+// compress, so the file is about as large as the decoded image.
+func noisePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func twoFrameGIF(t *testing.T) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < 2; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 32, 32), palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8((i + j) % 2)
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// allocated returns the bytes allocated while f runs.
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// fakeEmbedder answers /embed/image with a fixed vector and records the
+// bytes it was sent.
+func fakeEmbedder(t *testing.T, h *Handlers) *[]byte {
+	t.Helper()
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+		w.Write([]byte(`{"embedding": [1, 0, 0]}`))
+	}))
+	t.Cleanup(srv.Close)
+	h.embedURL = srv.URL
+	h.httpClient = srv.Client()
+	return &got
+}
+
+func TestDecodeStreamedMemoryIsBoundedByDecodedImage(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	h := &Handlers{storage: store}
+
+	const side = 2048
+	data := noisePNG(t, side, side)
+	if err := store.UploadFile(ctx, "images/u/big", data, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	var d *decodedImage
+	var err error
+	alloc := allocated(func() {
+		d, err = h.decodeForIngest(ctx, ingestInput{UserID: "u", Key: "images/u/big", Checked: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.data != nil {
+		t.Fatal("PNG was buffered instead of streamed")
+	}
+	if d.sha256 != sha256Hex(data) || d.size != int64(len(data)) {
+		t.Errorf("hashed %s of %d bytes, want %s of %d", d.sha256, d.size, sha256Hex(data), len(data))
+	}
+
+	// The decoded pixels plus the peek buffer and decoder state; holding the
+	// file as well would add another len(data) bytes.
+	pixels := uint64(side * side * 4)
+	limit := pixels + 4<<20
+	if alloc > limit {
+		t.Errorf("streamed decode allocated %d bytes, want at most %d (file is %d bytes)", alloc, limit, len(data))
+	}
+	if pixels+uint64(len(data)) <= limit {
+		t.Fatalf("test image too small to tell streaming from buffering")
+	}
+}
+
+func TestEmbedStoredStreamsPortableImagesUnchanged(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	h := &Handlers{storage: store}
+	sent := fakeEmbedder(t, h)
+
+	data := noisePNG(t, 64, 64)
+	if err := store.UploadFile(ctx, "images/u/a", data, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.embedStored(ctx, "images/u/a"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(*sent, data) {
+		t.Errorf("embedding service got %d bytes, want the %d byte file as stored", len(*sent), len(data))
+	}
+}
+
+func TestDecodeForIngestBuffersNonStreamableFormats(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	h := &Handlers{storage: store}
+
+	data := twoFrameGIF(t)
+	if err := store.UploadFile(ctx, "images/u/anim", data, "image/gif"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := h.decodeForIngest(ctx, ingestInput{UserID: "u", Key: "images/u/anim", Checked: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.data, data) {
+		t.Fatal("GIF was not buffered")
+	}
+	if d.format != "gif" || d.sha256 != sha256Hex(data) {
+		t.Errorf("got format %q hash %s, want gif %s", d.format, d.sha256, sha256Hex(data))
+	}
+}
+
+func TestEmbedStoredBuffersGIFsWithinTheUploadLimit(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	h := &Handlers{storage: store, gifFrames: 2}
+	fakeEmbedder(t, h)
+
+	data := twoFrameGIF(t)
+	if err := store.UploadFile(ctx, "images/u/anim", data, "image/gif"); err != nil {
+		t.Fatal(err)
+	}
+	emb, err := h.embedStored(ctx, "images/u/anim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emb) != 3 {
+		t.Errorf("got embedding %v", emb)
+	}
+
+	h.maxUploadBytes = int64(len(data)) - 1
+	if _, err := h.embedStored(ctx, "images/u/anim"); !errors.Is(err, errFileTooLarge) {
+		t.Errorf("over the limit: got %v, want errFileTooLarge", err)
+	}
+}
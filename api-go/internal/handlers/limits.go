@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/visual-anomaly/api-go/internal/imaging"
+)
+
+var (
+	errFileTooLarge    = errors.New("file too large")
+	errTooManyPixels   = errors.New("image dimensions too large")
+	errContentMismatch = errors.New("content does not match declared type")
+	errQuotaExceeded   = errors.New("upload quota exceeded")
+	// errQuotaUnavailable fails uploads whose quota usage cannot be read,
+	// rather than letting them through unchecked.
+	errQuotaUnavailable = errors.New("upload quota cannot be checked, try again later")
+)
+
+// genericContentTypes say nothing about the format, so they are not
+// checked against the content.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// checkUpload enforces the upload limits before an image is fully decoded:
+// file size, pixel count read from the header (decompression bombs declare
+// huge dimensions in a few bytes), the declared content type against the
+// sniffed format, and the owner's quota. head is the file or, for streamed
+// files, its first bytes; size is that of the whole file.
+func (h *Handlers) checkUpload(ctx context.Context, userID string, head []byte, size int64, contentType string) error {
+	if h.maxUploadBytes > 0 && size > h.maxUploadBytes {
+		return fmt.Errorf("%w: %d bytes, limit is %d", errFileTooLarge, size, h.maxUploadBytes)
+	}
+
+	ct := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	if sniffed := imaging.Sniff(head); !genericContentTypes[ct] && sniffed != "" {
+		if declared := imaging.FormatForContentType(ct); declared != sniffed {
+			return fmt.Errorf("%w: declared %s, content is %s", errContentMismatch, ct, sniffed)
+		}
+	}
+
+	if err := h.checkPixels(head); err != nil {
+		return err
+	}
+
+	return h.checkQuota(ctx, userID, size)
+}
+
+// checkPixels fails for images whose header, which head must hold, declares
+// more than IMAGE_MAX_PIXELS.
+func (h *Handlers) checkPixels(head []byte) error {
+	cfg, _, err := imaging.DecodeConfig(head)
+	if err != nil {
+		return decodeError(err)
+	}
+	if pixels := int64(cfg.Width) * int64(cfg.Height); h.maxPixels > 0 && pixels > h.maxPixels {
+		return fmt.Errorf("%w: %dx%d is %d pixels, limit is %d", errTooManyPixels, cfg.Width, cfg.Height, pixels, h.maxPixels)
+	}
+	return nil
+}
+
+// checkImage enforces the size and pixel limits on client-supplied image
+// bytes that are decoded outside ingest, such as search queries.
+func (h *Handlers) checkImage(data []byte) error {
+	if h.maxUploadBytes > 0 && int64(len(data)) > h.maxUploadBytes {
+		return fmt.Errorf("%w: %d bytes, limit is %d", errFileTooLarge, len(data), h.maxUploadBytes)
+	}
+	return h.checkPixels(data)
+}
+
+// readLimited reads r to the end, failing with errFileTooLarge past
+// UPLOAD_MAX_BYTES instead of buffering an unbounded body.
+func (h *Handlers) readLimited(r io.Reader) ([]byte, error) {
+	if h.maxUploadBytes <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, h.maxUploadBytes+1))
+	if err == nil && int64(len(data)) > h.maxUploadBytes {
+		err = fmt.Errorf("%w: limit is %d bytes", errFileTooLarge, h.maxUploadBytes)
+	}
+	return data, err
+}
+
+// decodeBounded decodes the image read from r, whose first bytes are head
+// as returned by imaging.Peek, once its header passes checkPixels. Stored
+// originals may predate the limits, so they are decoded through here too.
+// When the image header lies past head the file is buffered, up to
+// UPLOAD_MAX_BYTES, to find it.
+func (h *Handlers) decodeBounded(r io.Reader, head []byte) (image.Image, error) {
+	if _, _, err := imaging.DecodeConfig(head); err != nil && len(head) >= imaging.HeaderSize {
+		data, err := h.readLimited(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.checkPixels(data); err != nil {
+			return nil, err
+		}
+		img, _, err := imaging.Decode(data)
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		return img, nil
+	}
+	if err := h.checkPixels(head); err != nil {
+		return nil, err
+	}
+	img, _, err := imaging.DecodeFrom(r, head)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return img, nil
+}
+
+// isLimitError reports whether err is a size or pixel limit failure.
+func isLimitError(err error) bool {
+	return errors.Is(err, errFileTooLarge) || errors.Is(err, errTooManyPixels)
+}
+
+// respondLimitError answers a size or pixel limit failure.
+func respondLimitError(c *gin.Context, err error) {
+	code := "FILE_TOO_LARGE"
+	if errors.Is(err, errTooManyPixels) {
+		code = "TOO_MANY_PIXELS"
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "code": code})
+}
+
+// checkQuota fails when one more image of size bytes would take the user
+// over UPLOAD_QUOTA_IMAGES or UPLOAD_QUOTA_BYTES. Usage counts the images in
+// image_uploads that have not been deleted; without a database there is no
+// quota. When usage cannot be read, it fails with errQuotaUnavailable.
+func (h *Handlers) checkQuota(ctx context.Context, userID string, size int64) error {
+	if h.db == nil || (h.quotaImages <= 0 && h.quotaBytes <= 0) {
+		return nil
+	}
+	var count, used int64
+	err := h.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(size_bytes), 0) FROM image_uploads
+		WHERE user_id = $1 AND deleted_at IS NULL
+	`, userID).Scan(&count, &used)
+	if err != nil {
+		slog.Error("Failed to read upload quota usage", "error", err, "user_id", userID)
+		return errQuotaUnavailable
+	}
+	if h.quotaImages > 0 && count >= h.quotaImages {
+		return fmt.Errorf("%w: %d of %d images used", errQuotaExceeded, count, h.quotaImages)
+	}
+	if h.quotaBytes > 0 && used+size > h.quotaBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, upload is %d", errQuotaExceeded, used, h.quotaBytes, size)
+	}
+	return nil
+}
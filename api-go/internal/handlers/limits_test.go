@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unreachableDB fails every connection attempt.
+type unreachableDB struct{}
+
+func (unreachableDB) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("connection refused")
+}
+func (unreachableDB) Driver() driver.Driver { return nil }
+
+func TestCheckQuotaFailsWhenUsageIsUnavailable(t *testing.T) {
+	db := sql.OpenDB(unreachableDB{})
+	defer db.Close()
+	h := &Handlers{db: db, quotaImages: 10}
+
+	err := h.checkQuota(context.Background(), "u", 1)
+	if !errors.Is(err, errQuotaUnavailable) {
+		t.Fatalf("got %v, want errQuotaUnavailable", err)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	respondIngestError(c, err)
+	var resp struct{ Code string }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.Code != "QUOTA_UNAVAILABLE" {
+		t.Errorf("got %d %s, want 503 QUOTA_UNAVAILABLE", w.Code, resp.Code)
+	}
+
+	// Without a quota the database is not consulted
+	h.quotaImages = 0
+	if err := h.checkQuota(context.Background(), "u", 1); err != nil {
+		t.Errorf("no quota: got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/corona10/goimagehash"
+	"github.com/visual-anomaly/api-go/internal/anomaly"
+	"github.com/visual-anomaly/api-go/internal/imaging"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+var (
+	errImageNotFound = errors.New("image not found")
+	errBadQuery      = errors.New("invalid query")
+)
+
+// mmrOverfetch is how many candidates per requested result are fetched when
+// the results are filtered or re-ranked after the search.
+const mmrOverfetch = 5
+
+// rrfK is the rank offset of Reciprocal Rank Fusion. 60 is the value from
+// the original paper and damps the influence of the very top ranks.
+const rrfK = 60
+
+// queryInput is one part of a composed search query. Negative weights push
+// results away from the input ("like this image, but not at night").
+type queryInput struct {
+	ImageID  string   `json:"image_id"`
+	ImageURL string   `json:"image_url"`
+	Text     string   `json:"text"`
+	Weight   *float64 `json:"weight"`
+
+	upload []byte // uploaded image bytes
+	vector []float32
+	phash  *goimagehash.ImageHash // set for image inputs with a known pHash
+}
+
+func (in *queryInput) weight() float64 {
+	if in.Weight == nil {
+		return 1
+	}
+	return *in.Weight
+}
+
+// fetchQueryInputs downloads the images of image_url inputs, which are then
+// handled like uploads. Fetch failures are the client's problem: the URL is
+// blocked, unreachable, too large or not an image.
+func (h *Handlers) fetchQueryInputs(ctx context.Context, inputs []queryInput) error {
+	for i := range inputs {
+		in := &inputs[i]
+		if in.ImageURL == "" || in.upload != nil {
+			continue
+		}
+		data, _, err := h.fetcher.Image(ctx, in.ImageURL)
+		if err != nil {
+			return fmt.Errorf("%w: image_url: %v", errBadQuery, err)
+		}
+		if err := h.checkImage(data); err != nil {
+			if isLimitError(err) {
+				return err
+			}
+			return fmt.Errorf("%w: image_url: %v", errBadQuery, err)
+		}
+		in.upload = data
+	}
+	return nil
+}
+
+// embedQueryInputs fills in the vector of every input, looking stored images
+// up by ID and embedding uploads and text through the embedding service.
+func (h *Handlers) embedQueryInputs(ctx context.Context, inputs []queryInput) error {
+	for i := range inputs {
+		in := &inputs[i]
+		switch {
+		case in.vector != nil:
+		case in.upload != nil:
+			if err := h.checkImage(in.upload); err != nil {
+				return queryImageError(err)
+			}
+			upright, err := imaging.Upright(in.upload)
+			if err != nil {
+				return queryImageError(err)
+			}
+			v, err := h.getImageEmbedding(upright)
+			if err != nil {
+				return fmt.Errorf("%w: %v", errEmbedding, err)
+			}
+			in.vector = v
+			in.phash, _ = uploadPhash(in.upload)
+		case in.ImageID != "":
+			p, err := h.findPoint(ctx, normalizePointID(in.ImageID), true)
+			if err != nil || p == nil {
+				return fmt.Errorf("%w: %s", errImageNotFound, in.ImageID)
+			}
+			in.vector = p.Vector
+			if s, ok := p.Payload["phash"].(string); ok {
+				in.phash, _ = goimagehash.ImageHashFromString(s)
+			}
+		case in.Text != "":
+			v, err := h.getTextEmbedding(in.Text)
+			if err != nil {
+				return fmt.Errorf("%w: %v", errEmbedding, err)
+			}
+			in.vector = v
+		default:
+			return fmt.Errorf("%w: each query needs image_id, image_url or text", errBadQuery)
+		}
+	}
+	return nil
+}
+
+// composeWeighted sums the unit-normalized input vectors by weight.
+func composeWeighted(inputs []queryInput) []float32 {
+	var sum []float64
+	for _, in := range inputs {
+		if sum == nil {
+			sum = make([]float64, len(in.vector))
+		}
+		var norm float64
+		for _, x := range in.vector {
+			norm += float64(x) * float64(x)
+		}
+		if norm == 0 {
+			continue
+		}
+		scale := in.weight() / math.Sqrt(norm)
+		for i := 0; i < len(sum) && i < len(in.vector); i++ {
+			sum[i] += scale * float64(in.vector[i])
+		}
+	}
+	out := make([]float32, len(sum))
+	for i, x := range sum {
+		out[i] = float32(x)
+	}
+	return out
+}
+
+// fuseRRF runs one search per input and merges the ranked lists with
+// weighted Reciprocal Rank Fusion. The fused score replaces the similarity
+// score; base carries the shared filter, threshold and limit.
+func (h *Handlers) fuseRRF(ctx context.Context, inputs []queryInput, base qdrant.SearchRequest) ([]qdrant.SearchResult, error) {
+	limit := base.Limit
+	// Over-fetch so that items ranked lower by one input can still surface.
+	base.Limit = limit * 3
+	base.WithPayload = true
+
+	type fused struct {
+		result qdrant.SearchResult
+		score  float64
+	}
+	byID := map[string]*fused{}
+	for _, in := range inputs {
+		req := base
+		req.Vector = in.vector
+		results, err := h.qdrant.Search(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		for rank, r := range results {
+			key := anomaly.IDKey(r.ID)
+			f, ok := byID[key]
+			if !ok {
+				f = &fused{result: r}
+				byID[key] = f
+			}
+			f.score += in.weight() / float64(rrfK+rank+1)
+		}
+	}
+
+	merged := make([]fused, 0, len(byID))
+	for _, f := range byID {
+		if f.score > 0 {
+			merged = append(merged, *f)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].score > merged[j].score })
+	if len(merged) > limit {
+		merged = merged[:limit]
+	}
+
+	out := make([]qdrant.SearchResult, 0, len(merged))
+	for _, f := range merged {
+		r := f.result
+		r.Score = float32(f.score)
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// rerankMMR picks limit results by maximal marginal relevance: each step takes
+// the candidate maximizing lambda*relevance - (1-lambda)*(highest cosine
+// similarity to an already picked result). Relevance is the search score
+// scaled to [0, 1] over the candidates, so fused RRF scores work too.
+// Candidates need their vectors.
+func rerankMMR(candidates []qdrant.SearchResult, lambda float64, limit int) []qdrant.SearchResult {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	lo, hi := float64(candidates[0].Score), float64(candidates[0].Score)
+	for _, r := range candidates {
+		lo, hi = math.Min(lo, float64(r.Score)), math.Max(hi, float64(r.Score))
+	}
+	relevance := make([]float64, len(candidates))
+	for i, r := range candidates {
+		relevance[i] = 1
+		if hi > lo {
+			relevance[i] = (float64(r.Score) - lo) / (hi - lo)
+		}
+	}
+
+	// redundancy[i] is the highest similarity of candidate i to a picked one.
+	redundancy := make([]float64, len(candidates))
+	for i := range redundancy {
+		redundancy[i] = math.Inf(-1)
+	}
+	picked := make([]bool, len(candidates))
+	out := make([]qdrant.SearchResult, 0, limit)
+	for len(out) < limit && len(out) < len(candidates) {
+		best, bestScore := -1, math.Inf(-1)
+		for i := range candidates {
+			if picked[i] {
+				continue
+			}
+			score := lambda * relevance[i]
+			if len(out) > 0 {
+				score -= (1 - lambda) * redundancy[i]
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		picked[best] = true
+		out = append(out, candidates[best])
+		for i := range candidates {
+			if !picked[i] {
+				sim := 1 - anomaly.CosineDistance(candidates[i].Vector, candidates[best].Vector)
+				redundancy[i] = math.Max(redundancy[i], sim)
+			}
+		}
+	}
+	return out
+}
+
+// normalizePointID undoes the scientific notation that large numeric point
+// IDs pick up when a client round-trips them through a float.
+func normalizePointID(id string) string {
+	if !strings.Contains(id, "e+") {
+		return id
+	}
+	f, err := strconv.ParseFloat(id, 64)
+	if err != nil {
+		return id
+	}
+	return fmt.Sprintf("%.0f", f)
+}
+
+// queryImageError maps a failure to check or decode a query image. Limit
+// failures keep their own status.
+func queryImageError(err error) error {
+	var unsupported *imaging.UnsupportedFormatError
+	switch {
+	case isLimitError(err):
+		return err
+	case errors.As(err, &unsupported):
+		return fmt.Errorf("%w: %v", errBadQuery, unsupported)
+	}
+	return fmt.Errorf("%w: image could not be decoded", errBadQuery)
+}
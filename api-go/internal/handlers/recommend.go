@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/visual-anomaly/api-go/internal/anomaly"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+// Default Rocchio weights for the original query, the relevant examples and
+// the irrelevant examples.
+const (
+	rocchioAlpha = 1.0
+	rocchioBeta  = 0.75
+	rocchioGamma = 0.15
+)
+
+// Recommend refines a similarity search with relevance feedback. Positive
+// and negative examples come from the request and, with use_feedback, from
+// the caller's recent relevant/irrelevant feedback. The "recommend" and
+// "best_score" strategies use Qdrant's recommendation API; "rocchio" moves
+// the query vector towards the relevant and away from the irrelevant
+// examples and searches with the result.
+func (h *Handlers) Recommend(c *gin.Context) {
+	timer := prometheus.NewTimer(h.searchHist)
+	defer timer.ObserveDuration()
+
+	userID := c.GetString("user_id")
+
+	var req struct {
+		Positive       []string               `json:"positive"`
+		Negative       []string               `json:"negative"`
+		UseFeedback    bool                   `json:"use_feedback"`
+		FeedbackLimit  int                    `json:"feedback_limit"`
+		Strategy       string                 `json:"strategy"`
+		ImageID        string                 `json:"image_id"`   // rocchio: original query image
+		TextQuery      string                 `json:"text_query"` // rocchio: original query text
+		Alpha          *float64               `json:"alpha"`
+		Beta           *float64               `json:"beta"`
+		Gamma          *float64               `json:"gamma"`
+		Limit          int                    `json:"limit"`
+		ScoreThreshold *float32               `json:"score_threshold"`
+		Filter         map[string]interface{} `json:"filter"`
+		IncludePayload bool                   `json:"include_payload"`
+		ThumbnailSize  int                    `json:"thumbnail_size"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = "recommend"
+	}
+	if req.Strategy != "recommend" && req.Strategy != "best_score" && req.Strategy != "rocchio" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "strategy must be recommend, best_score or rocchio"})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = 10
+	}
+	if req.Limit > 100 {
+		req.Limit = 100
+	}
+	if req.FeedbackLimit <= 0 || req.FeedbackLimit > 100 {
+		req.FeedbackLimit = 20
+	}
+
+	ctx := c.Request.Context()
+
+	var feedbackPos, feedbackNeg []string
+	if req.UseFeedback {
+		var err error
+		feedbackPos, feedbackNeg, err = h.recentRelevanceFeedback(ctx, userID, req.FeedbackLimit)
+		if err != nil {
+			slog.Error("Recommend: loading feedback failed", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load feedback"})
+			return
+		}
+	}
+
+	withVectors := req.Strategy == "rocchio"
+	posPoints, err := h.resolvePoints(ctx, req.Positive, feedbackPos, withVectors)
+	if err != nil {
+		respondResolveError(c, err)
+		return
+	}
+	negPoints, err := h.resolvePoints(ctx, req.Negative, feedbackNeg, withVectors)
+	if err != nil {
+		respondResolveError(c, err)
+		return
+	}
+
+	var results []qdrant.SearchResult
+	if req.Strategy == "rocchio" {
+		var query []float32
+		if req.ImageID != "" {
+			p, err := h.findPoint(ctx, req.ImageID, true)
+			if err != nil || p == nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "image not found"})
+				return
+			}
+			query = p.Vector
+		} else if req.TextQuery != "" {
+			query, err = h.getTextEmbedding(req.TextQuery)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get text embedding"})
+				return
+			}
+		}
+		if query == nil && len(posPoints) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "rocchio needs image_id, text_query or at least one positive example"})
+			return
+		}
+
+		alpha, beta, gamma := orDefault(req.Alpha, rocchioAlpha), orDefault(req.Beta, rocchioBeta), orDefault(req.Gamma, rocchioGamma)
+		vector := rocchio(query, vectorsOf(posPoints), vectorsOf(negPoints), alpha, beta, gamma)
+
+		// Examples the user already judged are not interesting results.
+		var exclude []interface{}
+		for _, p := range append(posPoints, negPoints...) {
+			exclude = append(exclude, p.ID)
+		}
+		results, err = h.qdrant.Search(ctx, qdrant.SearchRequest{
+			Vector:      vector,
+			Filter:      req.Filter,
+			Limit:       req.Limit,
+			WithPayload: true,
+			Threshold:   req.ScoreThreshold,
+			ExcludeIDs:  exclude,
+		})
+	} else {
+		if len(posPoints) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "at least one positive example is required"})
+			return
+		}
+		strategy := "average_vector"
+		if req.Strategy == "best_score" {
+			strategy = "best_score"
+		}
+		results, err = h.qdrant.Recommend(ctx, qdrant.RecommendRequest{
+			Positive:    idsOf(posPoints),
+			Negative:    idsOf(negPoints),
+			Strategy:    strategy,
+			Filter:      req.Filter,
+			Limit:       req.Limit,
+			WithPayload: true,
+			Threshold:   req.ScoreThreshold,
+		})
+	}
+	if err != nil {
+		slog.Error("Recommend failed", "error", err, "strategy", req.Strategy)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "search failed"})
+		return
+	}
+
+	response := h.renderSearchResults(ctx, results, req.IncludePayload, req.ThumbnailSize)
+	c.JSON(http.StatusOK, gin.H{
+		"results":  response,
+		"count":    len(response),
+		"strategy": req.Strategy,
+		"positive": len(posPoints),
+		"negative": len(negPoints),
+	})
+}
+
+// recentRelevanceFeedback returns the images the user most recently marked
+// relevant and irrelevant. Only the latest mark per image counts.
+func (h *Handlers) recentRelevanceFeedback(ctx context.Context, userID string, limit int) (positive, negative []string, err error) {
+	if h.db == nil {
+		return nil, nil, nil
+	}
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT image_id, action FROM (
+			SELECT DISTINCT ON (image_id) image_id, action, created_at
+			FROM feedback
+			WHERE user_id = $1 AND action IN ('relevant', 'irrelevant')
+			ORDER BY image_id, created_at DESC
+		) latest
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, userID, 2*limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var imageID, action string
+		if err := rows.Scan(&imageID, &action); err != nil {
+			return nil, nil, err
+		}
+		if action == "relevant" && len(positive) < limit {
+			positive = append(positive, imageID)
+		} else if action == "irrelevant" && len(negative) < limit {
+			negative = append(negative, imageID)
+		}
+	}
+	return positive, negative, rows.Err()
+}
+
+// resolvePoints looks up the examples the caller gave, which must all
+// exist, and those taken from feedback, which are skipped once their image
+// has been deleted. Duplicates are dropped.
+func (h *Handlers) resolvePoints(ctx context.Context, ids, feedbackIDs []string, withVector bool) ([]qdrant.Point, error) {
+	all := append(append([]string(nil), ids...), feedbackIDs...)
+	if len(all) == 0 {
+		return nil, nil
+	}
+	found, err := h.findPoints(ctx, all, withVector)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var points []qdrant.Point
+	for i, id := range all {
+		p := found[id]
+		if p == nil {
+			if i < len(ids) {
+				return nil, fmt.Errorf("%w: %s", errImageNotFound, id)
+			}
+			continue
+		}
+		if key := anomaly.IDKey(p.ID); !seen[key] {
+			seen[key] = true
+			points = append(points, *p)
+		}
+	}
+	return points, nil
+}
+
+func respondResolveError(c *gin.Context, err error) {
+	if errors.Is(err, errImageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	slog.Error("Recommend: looking up examples failed", "error", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to look up examples"})
+}
+
+// rocchio computes alpha*query + beta*mean(relevant) - gamma*mean(irrelevant).
+// A nil query or an empty example list drops that term.
+func rocchio(query []float32, relevant, irrelevant [][]float32, alpha, beta, gamma float64) []float32 {
+	dim := len(query)
+	for _, v := range append(relevant, irrelevant...) {
+		if len(v) > dim {
+			dim = len(v)
+		}
+	}
+	out := make([]float64, dim)
+	add := func(v []float32, w float64) {
+		for i := range v {
+			out[i] += w * float64(v[i])
+		}
+	}
+	if query != nil {
+		add(query, alpha)
+	}
+	if len(relevant) > 0 {
+		add(anomaly.Centroid(relevant), beta)
+	}
+	if len(irrelevant) > 0 {
+		add(anomaly.Centroid(irrelevant), -gamma)
+	}
+	vector := make([]float32, dim)
+	for i, x := range out {
+		vector[i] = float32(x)
+	}
+	return vector
+}
+
+func vectorsOf(points []qdrant.Point) [][]float32 {
+	vectors := make([][]float32, 0, len(points))
+	for _, p := range points {
+		vectors = append(vectors, p.Vector)
+	}
+	return vectors
+}
+
+func idsOf(points []qdrant.Point) []interface{} {
+	ids := make([]interface{}, 0, len(points))
+	for _, p := range points {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func orDefault(v *float64, def float64) float64 {
+	if v == nil {
+		return def
+	}
+	return *v
+}
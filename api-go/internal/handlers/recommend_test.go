@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+func TestResolvePointsSkipsDeletedFeedbackImages(t *testing.T) {
+	// Qdrant knows point 1 only
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/points"):
+			w.Write([]byte(`{"result": [{"id": 1, "payload": {"image_id": "A"}}]}`))
+		case strings.HasSuffix(r.URL.Path, "/points/scroll"):
+			w.Write([]byte(`{"result": {"points": [], "next_page_offset": null}}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	q, _ := qdrant.NewClient(srv.URL, "")
+	h := &Handlers{qdrant: q}
+	ctx := context.Background()
+
+	points, err := h.resolvePoints(ctx, []string{"1"}, []string{"2", "1", "B"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 {
+		t.Errorf("got %d points, want 1", len(points))
+	}
+	if _, err := h.resolvePoints(ctx, []string{"1", "2"}, nil, false); !errors.Is(err, errImageNotFound) {
+		t.Errorf("missing caller ID: got %v, want errImageNotFound", err)
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+var errNoDatabase = errors.New("database not available")
+
+// referenceSet is a "golden" set of known-good images, selected by a tag or
+// an album. Anomaly scoring against a reference set measures how far an
+// image is from the set instead of from the whole collection.
+type referenceSet struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Field       string    `json:"field"` // "tags" or "album"
+	Value       string    `json:"value"`
+	OwnerUserID string    `json:"owner_user_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// filter selects the members of the set.
+func (rs *referenceSet) filter() map[string]interface{} {
+	return map[string]interface{}{rs.Field: rs.Value}
+}
+
+// contains reports whether a point belongs to the set.
+func (rs *referenceSet) contains(p qdrant.Payload) bool {
+	switch v := p[rs.Field].(type) {
+	case string:
+		return v == rs.Value
+	case []interface{}:
+		for _, t := range v {
+			if s, ok := t.(string); ok && s == rs.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *Handlers) CreateReferenceSet(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		Name  string `json:"name" binding:"required"`
+		Tag   string `json:"tag"`
+		Album string `json:"album"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.Tag == "") == (req.Album == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "exactly one of tag or album is required"})
+		return
+	}
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+
+	rs := referenceSet{Name: req.Name, Field: "tags", Value: req.Tag, OwnerUserID: userID, CreatedAt: time.Now().UTC()}
+	if req.Album != "" {
+		rs.Field, rs.Value = "album", req.Album
+	}
+
+	err := h.db.QueryRowContext(c.Request.Context(), `
+		INSERT INTO reference_sets (name, owner_user_id, field, value, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, rs.Name, rs.OwnerUserID, rs.Field, rs.Value, rs.CreatedAt).Scan(&rs.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			c.JSON(http.StatusConflict, gin.H{"error": "reference set already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create reference set"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rs)
+}
+
+func (h *Handlers) ListReferenceSets(c *gin.Context) {
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+
+	rows, err := h.db.QueryContext(c.Request.Context(), `
+		SELECT id, name, owner_user_id, field, value, created_at
+		FROM reference_sets ORDER BY name
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list reference sets"})
+		return
+	}
+	defer rows.Close()
+
+	sets := []gin.H{}
+	for rows.Next() {
+		var rs referenceSet
+		if err := rows.Scan(&rs.ID, &rs.Name, &rs.OwnerUserID, &rs.Field, &rs.Value, &rs.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list reference sets"})
+			return
+		}
+		members, _ := h.qdrant.Count(c.Request.Context(), rs.filter())
+		sets = append(sets, gin.H{
+			"id":            rs.ID,
+			"name":          rs.Name,
+			"field":         rs.Field,
+			"value":         rs.Value,
+			"owner_user_id": rs.OwnerUserID,
+			"created_at":    rs.CreatedAt,
+			"members":       members,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reference_sets": sets, "count": len(sets)})
+}
+
+func (h *Handlers) DeleteReferenceSet(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "reference set not found"})
+		return
+	}
+
+	res, err := h.db.ExecContext(c.Request.Context(), `DELETE FROM reference_sets WHERE id = $1 AND owner_user_id = $2`, id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete reference set"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "reference set not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// getReferenceSet looks a reference set up by name.
+func (h *Handlers) getReferenceSet(ctx context.Context, name string) (*referenceSet, error) {
+	if h.db == nil {
+		return nil, errNoDatabase
+	}
+	var rs referenceSet
+	err := h.db.QueryRowContext(ctx, `
+		SELECT id, name, owner_user_id, field, value, created_at
+		FROM reference_sets WHERE name = $1
+	`, name).Scan(&rs.ID, &rs.Name, &rs.OwnerUserID, &rs.Field, &rs.Value, &rs.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
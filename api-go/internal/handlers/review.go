@@ -0,0 +1,437 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/visual-anomaly/api-go/internal/anomaly"
+	"github.com/visual-anomaly/api-go/internal/webhook"
+)
+
+// Review item states.
+const (
+	reviewOpen      = "open"
+	reviewAssigned  = "assigned"
+	reviewConfirmed = "confirmed"
+	reviewDismissed = "dismissed"
+	reviewEscalated = "escalated"
+)
+
+// reviewTransitions lists the states each state may move to. Confirmed and
+// dismissed are final.
+var reviewTransitions = map[string][]string{
+	reviewOpen:      {reviewAssigned, reviewConfirmed, reviewDismissed, reviewEscalated},
+	reviewAssigned:  {reviewOpen, reviewConfirmed, reviewDismissed, reviewEscalated},
+	reviewEscalated: {reviewAssigned, reviewConfirmed, reviewDismissed},
+}
+
+// reviewFeedbackActions maps review decisions to the feedback action they
+// record, so that decisions feed threshold calibration.
+var reviewFeedbackActions = map[string]string{
+	reviewConfirmed: "anomaly",
+	reviewDismissed: "normal",
+	reviewEscalated: "escalated",
+}
+
+const defaultReviewLease = 15 * time.Minute
+
+type reviewItem struct {
+	ID             int64      `json:"id"`
+	ImageID        string     `json:"image_id"`
+	AnomalyScore   float64    `json:"anomaly_score"`
+	State          string     `json:"state"`
+	Assignee       *string    `json:"assignee"`
+	LeaseOwner     *string    `json:"lease_owner"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at"`
+	Note           *string    `json:"note"`
+	DecidedBy      *string    `json:"decided_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+const reviewColumns = `id, image_id, anomaly_score, state, assignee, lease_owner, lease_expires_at, note, decided_by, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReviewItem(row rowScanner) (*reviewItem, error) {
+	var it reviewItem
+	err := row.Scan(&it.ID, &it.ImageID, &it.AnomalyScore, &it.State, &it.Assignee, &it.LeaseOwner,
+		&it.LeaseExpiresAt, &it.Note, &it.DecidedBy, &it.CreatedAt, &it.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+// leaseHeldBy reports whether user holds an unexpired lease on the item.
+func (it *reviewItem) leaseHeldBy(user string, now time.Time) bool {
+	return it.LeaseOwner != nil && *it.LeaseOwner == user && it.LeaseExpiresAt != nil && it.LeaseExpiresAt.After(now)
+}
+
+// leasedByOther reports whether someone other than user holds an unexpired
+// lease on the item.
+func (it *reviewItem) leasedByOther(user string, now time.Time) bool {
+	return it.LeaseOwner != nil && *it.LeaseOwner != user && it.LeaseExpiresAt != nil && it.LeaseExpiresAt.After(now)
+}
+
+func (h *Handlers) ListReviewItems(c *gin.Context) {
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+
+	limit := queryInt(c, "limit", 50, 1, 200)
+	offset := queryInt(c, "offset", 0, 0, 1<<31-1)
+
+	query := `SELECT ` + reviewColumns + ` FROM review_items WHERE 1=1`
+	var args []interface{}
+	if state := c.Query("state"); state != "" {
+		args = append(args, state)
+		query += fmt.Sprintf(" AND state = $%d", len(args))
+	}
+	if assignee := c.Query("assignee"); assignee != "" {
+		args = append(args, assignee)
+		query += fmt.Sprintf(" AND assignee = $%d", len(args))
+	}
+	args = append(args, limit, offset)
+	query += fmt.Sprintf(" ORDER BY anomaly_score DESC, id LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := h.db.QueryContext(c.Request.Context(), query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list review items"})
+		return
+	}
+	defer rows.Close()
+
+	items := []*reviewItem{}
+	for rows.Next() {
+		it, err := scanReviewItem(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list review items"})
+			return
+		}
+		items = append(items, it)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": items, "count": len(items), "limit": limit, "offset": offset})
+}
+
+// ClaimNextReviewItem leases the most anomalous unleased item that is open,
+// escalated or assigned to the caller.
+func (h *Handlers) ClaimNextReviewItem(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	lease := reviewLease(c)
+	now := time.Now().UTC()
+
+	// SKIP LOCKED keeps concurrent claims from blocking on, or grabbing, the
+	// same row.
+	row := h.db.QueryRowContext(c.Request.Context(), `
+		UPDATE review_items SET lease_owner = $1, lease_expires_at = $2, updated_at = $3
+		WHERE id = (
+			SELECT id FROM review_items
+			WHERE state IN ('open', 'assigned', 'escalated')
+				AND (assignee IS NULL OR assignee = $1)
+				AND (lease_expires_at IS NULL OR lease_expires_at < $3 OR lease_owner = $1)
+			ORDER BY anomaly_score DESC, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+reviewColumns, userID, now.Add(lease), now)
+	it, err := scanReviewItem(row)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no review items available"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to claim review item"})
+		return
+	}
+	c.JSON(http.StatusOK, it)
+}
+
+// ClaimReviewItem leases a specific item. It fails with 409 while another
+// reviewer holds the lease.
+func (h *Handlers) ClaimReviewItem(c *gin.Context) {
+	userID := c.GetString("user_id")
+	lease := reviewLease(c)
+	h.updateReviewItem(c, func(it *reviewItem, now time.Time) (int, string) {
+		if reviewTransitions[it.State] == nil {
+			return http.StatusConflict, "review item is already decided"
+		}
+		if it.leasedByOther(userID, now) {
+			return http.StatusConflict, "review item is leased by another reviewer"
+		}
+		expires := now.Add(lease)
+		it.LeaseOwner, it.LeaseExpiresAt = &userID, &expires
+		return 0, ""
+	})
+}
+
+// ReleaseReviewItem gives up the caller's lease.
+func (h *Handlers) ReleaseReviewItem(c *gin.Context) {
+	userID := c.GetString("user_id")
+	h.updateReviewItem(c, func(it *reviewItem, now time.Time) (int, string) {
+		if !it.leaseHeldBy(userID, now) {
+			return http.StatusConflict, "review item is not leased by you"
+		}
+		it.LeaseOwner, it.LeaseExpiresAt = nil, nil
+		return 0, ""
+	})
+}
+
+func (h *Handlers) AssignReviewItem(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		Assignee string `json:"assignee" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.updateReviewItem(c, func(it *reviewItem, now time.Time) (int, string) {
+		if !canTransition(it.State, reviewAssigned) && it.State != reviewAssigned {
+			return http.StatusConflict, fmt.Sprintf("cannot assign a %s review item", it.State)
+		}
+		if it.leasedByOther(userID, now) {
+			return http.StatusConflict, "review item is leased by another reviewer"
+		}
+		it.State, it.Assignee = reviewAssigned, &req.Assignee
+		// The lease belonged to the previous reviewer.
+		it.LeaseOwner, it.LeaseExpiresAt = nil, nil
+		return 0, ""
+	})
+}
+
+// TransitionReviewItem moves an item to open, confirmed, dismissed or
+// escalated. The caller must hold the lease; decisions are recorded in the
+// feedback table.
+func (h *Handlers) TransitionReviewItem(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		State string `json:"state" binding:"required,oneof=open confirmed dismissed escalated"`
+		Note  string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.updateReviewItem(c, func(it *reviewItem, now time.Time) (int, string) {
+		if !canTransition(it.State, req.State) {
+			return http.StatusConflict, fmt.Sprintf("cannot move review item from %s to %s", it.State, req.State)
+		}
+		if !it.leaseHeldBy(userID, now) {
+			return http.StatusConflict, "claim the review item before deciding on it"
+		}
+		it.State = req.State
+		if req.Note != "" {
+			it.Note = &req.Note
+		}
+		if _, ok := reviewFeedbackActions[req.State]; ok {
+			it.DecidedBy = &userID
+		}
+		if req.State == reviewOpen {
+			it.Assignee = nil
+		}
+		it.LeaseOwner, it.LeaseExpiresAt = nil, nil
+		return 0, ""
+	}, func(ctx context.Context, tx *sql.Tx, it *reviewItem, now time.Time) error {
+		action, ok := reviewFeedbackActions[it.State]
+		if !ok {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO feedback (image_id, user_id, action, note, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, it.ImageID, userID, action, req.Note, now)
+		return err
+	})
+}
+
+// updateReviewItem loads the item named by the :id parameter under a row
+// lock, lets mutate change it, writes it back and runs the after hooks in
+// the same transaction. mutate returns a non-zero status to reject the
+// change.
+func (h *Handlers) updateReviewItem(c *gin.Context, mutate func(it *reviewItem, now time.Time) (int, string), after ...func(ctx context.Context, tx *sql.Tx, it *reviewItem, now time.Time) error) {
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid review item id"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update review item"})
+		return
+	}
+	defer tx.Rollback()
+
+	it, err := scanReviewItem(tx.QueryRowContext(ctx, `SELECT `+reviewColumns+` FROM review_items WHERE id = $1 FOR UPDATE`, id))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "review item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update review item"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if status, msg := mutate(it, now); status != 0 {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	it.UpdatedAt = now
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE review_items
+		SET state = $2, assignee = $3, lease_owner = $4, lease_expires_at = $5, note = $6, decided_by = $7, updated_at = $8
+		WHERE id = $1
+	`, it.ID, it.State, it.Assignee, it.LeaseOwner, it.LeaseExpiresAt, it.Note, it.DecidedBy, it.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update review item"})
+		return
+	}
+	for _, fn := range after {
+		if err := fn(ctx, tx, it, now); err != nil {
+			slog.Error("Review: post-update hook failed", "error", err, "review_item_id", it.ID)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update review item"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update review item"})
+		return
+	}
+
+	c.JSON(http.StatusOK, it)
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range reviewTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewLease reads the optional lease_seconds query parameter.
+func reviewLease(c *gin.Context) time.Duration {
+	secs := queryInt(c, "lease_seconds", int(defaultReviewLease/time.Second), 30, 24*3600)
+	return time.Duration(secs) * time.Second
+}
+
+// flagAnomalies turns freshly scored images at or above their owner's
+// calibrated anomaly threshold (or ANOMALY_FLAG_THRESHOLD for owners without
+// one) into open review items. Images with an unresolved item are skipped.
+func (h *Handlers) flagAnomalies(ctx context.Context, results []anomaly.Result) {
+	if h.db == nil {
+		return
+	}
+
+	method := string(h.anomalyJob.Method())
+	thresholds := map[string]float64{}
+	rows, err := h.db.QueryContext(ctx, `SELECT tenant_id, threshold FROM calibrations WHERE kind = $1 AND method = $2`, calibrationAnomaly, method)
+	if err != nil {
+		slog.Error("Review: loading thresholds failed", "error", err)
+		return
+	}
+	lowest, hasDefault := h.flagThreshold, h.flagThreshold != nil
+	for rows.Next() {
+		var tenant string
+		var t float64
+		if err := rows.Scan(&tenant, &t); err == nil {
+			thresholds[tenant] = t
+			if lowest == nil || t < *lowest {
+				tt := t
+				lowest = &tt
+			}
+		}
+	}
+	rows.Close()
+	if lowest == nil {
+		return // nothing calibrated and no default threshold
+	}
+
+	var candidates []interface{}
+	scores := map[string]float64{}
+	for _, r := range results {
+		if r.Score >= *lowest {
+			candidates = append(candidates, r.ID)
+			scores[anomaly.IDKey(r.ID)] = r.Score
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	points, err := h.qdrant.RetrievePoints(ctx, candidates, false)
+	if err != nil {
+		slog.Error("Review: loading flagged points failed", "error", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, p := range points {
+		score := scores[anomaly.IDKey(p.ID)]
+		owner, _ := p.Payload["owner_user_id"].(string)
+		threshold, ok := thresholds[owner]
+		if !ok {
+			if !hasDefault {
+				continue
+			}
+			threshold = *h.flagThreshold
+		}
+		if score < threshold {
+			continue
+		}
+		// Items are keyed by the payload image_id, like feedback and
+		// webhooks. An image that was ever reviewed is not flagged again,
+		// whatever the decision, and the partial unique index covers
+		// concurrent flags.
+		imageID, _ := p.Payload["image_id"].(string)
+		if imageID == "" {
+			continue
+		}
+		res, err := h.db.ExecContext(ctx, `
+			INSERT INTO review_items (image_id, anomaly_score, state, created_at, updated_at)
+			SELECT $1::varchar, $2::double precision, $3::varchar, $4::timestamp, $4::timestamp
+			WHERE NOT EXISTS (SELECT 1 FROM review_items WHERE image_id = $1)
+			ON CONFLICT DO NOTHING
+		`, imageID, score, reviewOpen, now)
+		if err != nil {
+			slog.Error("Review: creating review item failed", "error", err, "point_id", p.ID)
+			continue
+		}
+		// Only newly opened items are announced, not images already in review
+		if n, _ := res.RowsAffected(); n > 0 {
+			h.webhooks.Emit(ctx, owner, webhook.EventAnomalyFlagged, gin.H{
+				"image_id":      imageID,
+				"point_id":      anomaly.IDKey(p.ID),
+				"anomaly_score": score,
+				"threshold":     threshold,
+				"method":        method,
+			})
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/visual-anomaly/api-go/internal/anomaly"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+// savedSearchSweepLimit bounds the matches one saved search records per
+// sweep. Sweeps run after every ingest batch, so only a burst of more
+// matching images than this between two sweeps loses matches.
+const savedSearchSweepLimit = 100
+
+// savedSearchOverlap is how far a sweep looks back before the previous run.
+// An ingest stamps created_at just before its upsert, and Qdrant applies
+// upserts asynchronously, so a point can become searchable after a sweep
+// that started later than its created_at. Matches found twice are ignored
+// by the primary key.
+const savedSearchOverlap = time.Minute
+
+// savedSearch is a stored query that is re-run against newly ingested
+// images. The query vector is captured at creation, so the search keeps
+// working when its query image is deleted and text is embedded only once.
+type savedSearch struct {
+	ID             int64                  `json:"id"`
+	UserID         string                 `json:"user_id"`
+	Name           string                 `json:"name"`
+	ImageID        *string                `json:"image_id"`
+	TextQuery      *string                `json:"text_query"`
+	Filter         map[string]interface{} `json:"filter"`
+	ScoreThreshold float32                `json:"score_threshold"`
+	CreatedAt      time.Time              `json:"created_at"`
+	LastRunAt      time.Time              `json:"last_run_at"`
+
+	vector []float32
+}
+
+const savedSearchColumns = `id, user_id, name, image_id, text_query, filter, score_threshold, query_vector, created_at, last_run_at`
+
+func scanSavedSearch(row rowScanner) (*savedSearch, error) {
+	var ss savedSearch
+	var filter []byte
+	var vector []float64
+	err := row.Scan(&ss.ID, &ss.UserID, &ss.Name, &ss.ImageID, &ss.TextQuery, &filter,
+		&ss.ScoreThreshold, pq.Array(&vector), &ss.CreatedAt, &ss.LastRunAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(filter) > 0 {
+		if err := json.Unmarshal(filter, &ss.Filter); err != nil {
+			return nil, err
+		}
+	}
+	ss.vector = make([]float32, len(vector))
+	for i, x := range vector {
+		ss.vector[i] = float32(x)
+	}
+	return &ss, nil
+}
+
+// notifySavedSearches schedules a sweep of the saved searches. Notifications
+// that arrive while a sweep is pending are coalesced into it.
+func (h *Handlers) notifySavedSearches() {
+	select {
+	case h.savedSearchWake <- struct{}{}:
+	default:
+	}
+}
+
+// runSavedSearches sweeps the saved searches after ingests and every
+// interval, until ctx is done.
+func (h *Handlers) runSavedSearches(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-h.savedSearchWake:
+		}
+		if err := h.sweepSavedSearches(ctx); err != nil {
+			slog.Error("saved searches: sweep failed", "error", err)
+		}
+	}
+}
+
+// sweepSavedSearches runs every saved search against the images created
+// since its last run and records the matches.
+func (h *Handlers) sweepSavedSearches(ctx context.Context) error {
+	if h.db == nil {
+		return nil
+	}
+	rows, err := h.db.QueryContext(ctx, `SELECT `+savedSearchColumns+` FROM saved_searches ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var searches []*savedSearch
+	for rows.Next() {
+		ss, err := scanSavedSearch(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		searches = append(searches, ss)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(searches); start += maxBatchQueries {
+		end := start + maxBatchQueries
+		if end > len(searches) {
+			end = len(searches)
+		}
+		if err := h.sweepSavedSearchBatch(ctx, searches[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handlers) sweepSavedSearchBatch(ctx context.Context, searches []*savedSearch) error {
+	startedAt := time.Now().UTC()
+	reqs := make([]qdrant.SearchRequest, len(searches))
+	for i, ss := range searches {
+		filter := map[string]interface{}{}
+		for k, v := range ss.Filter {
+			filter[k] = v
+		}
+		filter["created_at"] = qdrant.DatetimeRange{GTE: ss.LastRunAt.Add(-savedSearchOverlap).UTC().Format(time.RFC3339)}
+		threshold := ss.ScoreThreshold
+		reqs[i] = qdrant.SearchRequest{
+			Vector:      ss.vector,
+			Filter:      filter,
+			Limit:       savedSearchSweepLimit,
+			WithPayload: true,
+			Threshold:   &threshold,
+		}
+	}
+
+	batch, err := h.qdrant.SearchBatch(ctx, reqs)
+	if err != nil {
+		return err
+	}
+
+	for i, results := range batch {
+		ss := searches[i]
+		for _, r := range results {
+			imageID, _ := r.Payload["image_id"].(string)
+			if imageID == "" {
+				imageID = anomaly.IDKey(r.ID)
+			}
+			_, err := h.db.ExecContext(ctx, `
+				INSERT INTO saved_search_matches (saved_search_id, image_id, point_id, score, matched_at)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (saved_search_id, image_id) DO NOTHING
+			`, ss.ID, imageID, anomaly.IDKey(r.ID), r.Score, startedAt)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := h.db.ExecContext(ctx, `UPDATE saved_searches SET last_run_at = $1 WHERE id = $2`, startedAt, ss.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handlers) CreateSavedSearch(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		Name           string                 `json:"name" binding:"required"`
+		ImageID        string                 `json:"image_id"`
+		TextQuery      string                 `json:"text_query"`
+		Filter         map[string]interface{} `json:"filter"`
+		ScoreThreshold *float32               `json:"score_threshold" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (req.ImageID == "") == (req.TextQuery == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "exactly one of image_id or text_query is required"})
+		return
+	}
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+
+	var vector []float32
+	if req.ImageID != "" {
+		req.ImageID = normalizePointID(req.ImageID)
+		p, err := h.findPoint(ctx, req.ImageID, true)
+		if err != nil || p == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "image not found"})
+			return
+		}
+		vector = p.Vector
+	} else {
+		v, err := h.getTextEmbedding(req.TextQuery)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get text embedding"})
+			return
+		}
+		vector = v
+	}
+	vector64 := make([]float64, len(vector))
+	for i, x := range vector {
+		vector64[i] = float64(x)
+	}
+
+	// Passed as text: lib/pq would send []byte as bytea.
+	var filter *string
+	if req.Filter != nil {
+		b, _ := json.Marshal(req.Filter)
+		f := string(b)
+		filter = &f
+	}
+	// Only images ingested from now on are new matches.
+	now := time.Now().UTC()
+	row := h.db.QueryRowContext(ctx, `
+		INSERT INTO saved_searches (user_id, name, image_id, text_query, filter, score_threshold, query_vector, created_at, last_run_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8, $8)
+		RETURNING `+savedSearchColumns,
+		userID, req.Name, req.ImageID, req.TextQuery, filter, *req.ScoreThreshold, pq.Array(vector64), now)
+	ss, err := scanSavedSearch(row)
+	if err != nil {
+		slog.Error("Failed to create saved search", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create saved search"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ss)
+}
+
+func (h *Handlers) ListSavedSearches(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+
+	rows, err := h.db.QueryContext(c.Request.Context(), `
+		SELECT s.id, s.name, s.image_id, s.text_query, s.filter, s.score_threshold, s.created_at, s.last_run_at,
+			COUNT(m.image_id), COUNT(m.image_id) FILTER (WHERE NOT m.seen)
+		FROM saved_searches s
+		LEFT JOIN saved_search_matches m ON m.saved_search_id = s.id
+		WHERE s.user_id = $1
+		GROUP BY s.id
+		ORDER BY s.created_at DESC
+	`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list saved searches"})
+		return
+	}
+	defer rows.Close()
+
+	searches := []gin.H{}
+	for rows.Next() {
+		var ss savedSearch
+		var filter []byte
+		var matches, unseen int
+		if err := rows.Scan(&ss.ID, &ss.Name, &ss.ImageID, &ss.TextQuery, &filter, &ss.ScoreThreshold,
+			&ss.CreatedAt, &ss.LastRunAt, &matches, &unseen); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list saved searches"})
+			return
+		}
+		if len(filter) > 0 {
+			_ = json.Unmarshal(filter, &ss.Filter)
+		}
+		searches = append(searches, gin.H{
+			"id":              ss.ID,
+			"name":            ss.Name,
+			"image_id":        ss.ImageID,
+			"text_query":      ss.TextQuery,
+			"filter":          ss.Filter,
+			"score_threshold": ss.ScoreThreshold,
+			"created_at":      ss.CreatedAt,
+			"last_run_at":     ss.LastRunAt,
+			"matches":         matches,
+			"unseen_matches":  unseen,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"saved_searches": searches, "count": len(searches)})
+}
+
+func (h *Handlers) DeleteSavedSearch(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saved search not found"})
+		return
+	}
+
+	res, err := h.db.ExecContext(c.Request.Context(), `DELETE FROM saved_searches WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete saved search"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saved search not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// GetSavedSearchMatches lists the images that matched a saved search, newest
+// first. With unseen=true only matches not yet marked seen are returned.
+func (h *Handlers) GetSavedSearchMatches(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+
+	if ok, err := h.ownsSavedSearch(ctx, c.Param("id"), userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load saved search"})
+		return
+	} else if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saved search not found"})
+		return
+	}
+
+	limit := queryInt(c, "limit", 50, 1, 200)
+	offset := queryInt(c, "offset", 0, 0, 1<<31-1)
+	unseenOnly := c.Query("unseen") == "true"
+
+	var total int
+	if err := h.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM saved_search_matches
+		WHERE saved_search_id = $1 AND (NOT $2 OR NOT seen)
+	`, c.Param("id"), unseenOnly).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load matches"})
+		return
+	}
+
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT image_id, point_id, score, matched_at, seen FROM saved_search_matches
+		WHERE saved_search_id = $1 AND (NOT $2 OR NOT seen)
+		ORDER BY matched_at DESC, score DESC
+		LIMIT $3 OFFSET $4
+	`, c.Param("id"), unseenOnly, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load matches"})
+		return
+	}
+	defer rows.Close()
+
+	type match struct {
+		imageID, pointID string
+		score            float64
+		matchedAt        time.Time
+		seen             bool
+	}
+	var page []match
+	var ids []interface{}
+	for rows.Next() {
+		var m match
+		if err := rows.Scan(&m.imageID, &m.pointID, &m.score, &m.matchedAt, &m.seen); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load matches"})
+			return
+		}
+		page = append(page, m)
+		ids = append(ids, json.Number(m.pointID))
+	}
+
+	// Deleted images keep their match but lose the preview.
+	points := map[string]int{}
+	var srcs []thumbnailSource
+	if len(ids) > 0 {
+		if pts, err := h.qdrant.RetrievePoints(ctx, ids, false); err == nil {
+			for _, p := range pts {
+				if _, ok := p.Payload["key"].(string); ok {
+					points[anomaly.IDKey(p.ID)] = len(srcs)
+					srcs = append(srcs, thumbnailSource{ID: p.ID, Payload: p.Payload})
+				}
+			}
+		}
+	}
+	thumbURLs := h.thumbnailURLs(ctx, srcs, queryInt(c, "thumbnail_size", 0, 0, 4096))
+
+	matches := make([]gin.H, 0, len(page))
+	for _, m := range page {
+		item := gin.H{
+			"image_id":   m.imageID,
+			"point_id":   m.pointID,
+			"score":      m.score,
+			"matched_at": m.matchedAt,
+			"seen":       m.seen,
+		}
+		if i, ok := points[m.pointID]; ok {
+			item["preview_url"] = h.contentURL(srcs[i].ID, "content", 0)
+			item["thumbnail_url"] = thumbURLs[i]
+		}
+		matches = append(matches, item)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"matches": matches,
+		"count":   len(matches),
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// MarkSavedSearchMatchesSeen marks all matches of a saved search as seen.
+func (h *Handlers) MarkSavedSearchMatchesSeen(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+
+	if ok, err := h.ownsSavedSearch(ctx, c.Param("id"), userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load saved search"})
+		return
+	} else if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saved search not found"})
+		return
+	}
+
+	res, err := h.db.ExecContext(ctx, `UPDATE saved_search_matches SET seen = TRUE WHERE saved_search_id = $1 AND NOT seen`, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update matches"})
+		return
+	}
+	n, _ := res.RowsAffected()
+	c.JSON(http.StatusOK, gin.H{"status": "seen", "updated": n})
+}
+
+func (h *Handlers) ownsSavedSearch(ctx context.Context, id, userID string) (bool, error) {
+	var one int
+	err := h.db.QueryRowContext(ctx, `SELECT 1 FROM saved_searches WHERE id = $1 AND user_id = $2`, id, userID).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		// Non-numeric IDs fail to parse on the server; treat them as unknown.
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "22P02" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/corona10/goimagehash"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/visual-anomaly/api-go/internal/imaging"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+var errEmbedding = errors.New("failed to get embedding")
+
+// groupByPattern limits group_by to plain (optionally nested) payload keys.
+var groupByPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// searchOutput holds either a flat result list or, with group_by, groups.
+type searchOutput struct {
+	results []qdrant.SearchResult
+	groups  []qdrant.Group
+	crop    map[string]interface{} // set for bbox queries
+}
+
+// searchParams are the parameters shared by every kind of similarity query.
+// They are read from the JSON body, or from form fields when an image is
+// uploaded as multipart/form-data.
+type searchParams struct {
+	ImageID        string                 `json:"image_id"`
+	ImageURL       string                 `json:"image_url"`
+	TextQuery      string                 `json:"text_query"`
+	Queries        []queryInput           `json:"queries"`
+	NegativeText   string                 `json:"negative_text"`
+	Fusion         string                 `json:"fusion"`
+	Limit          int                    `json:"limit"`
+	ScoreThreshold *float32               `json:"score_threshold"`
+	Filter         map[string]interface{} `json:"filter"`
+	UseCrops       bool                   `json:"use_crops"`
+	PhashGate      *int                   `json:"phash_gate"`
+	IncludePayload bool                   `json:"include_payload"`
+	GroupBy        string                 `json:"group_by"`
+	GroupSize      int                    `json:"group_size"`
+	Diversity      float64                `json:"diversity"`
+	BBox           *boundingBox           `json:"bbox"`
+	ThumbnailSize  int                    `json:"thumbnail_size"`
+
+	// upload is the image sent in the "image" form field, if any.
+	upload []byte
+}
+
+// SearchSimilar finds images similar to an uploaded image, stored images,
+// text, or a weighted composition of those. All query kinds share parameter
+// parsing, error codes and the response shape.
+func (h *Handlers) SearchSimilar(c *gin.Context) {
+	timer := prometheus.NewTimer(h.searchHist)
+	defer timer.ObserveDuration()
+
+	// userID := c.GetString("user_id") // Not used for learning project
+
+	var params searchParams
+	var err error
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		err = h.parseSearchForm(c, &params)
+	} else if err = c.ShouldBindJSON(&params); err != nil {
+		err = fmt.Errorf("%w: %v", errBadQuery, err)
+	}
+	if err == nil {
+		err = params.normalize()
+	}
+	if err != nil {
+		respondSearchError(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	out, err := h.runSearch(ctx, &params)
+	if err != nil {
+		respondSearchError(c, err)
+		return
+	}
+
+	if params.GroupBy == "" {
+		response := h.renderSearchResults(ctx, out.results, params.IncludePayload, params.ThumbnailSize)
+		body := gin.H{
+			"results": response,
+			"count":   len(response),
+			"fusion":  params.Fusion,
+		}
+		if out.crop != nil {
+			body["crop"] = out.crop
+		}
+		c.JSON(http.StatusOK, body)
+		return
+	}
+
+	// results holds the best hit of every group, so clients that ignore
+	// groups still get one result per group.
+	groups := make([]gin.H, 0, len(out.groups))
+	best := make([]qdrant.SearchResult, 0, len(out.groups))
+	for _, g := range out.groups {
+		groups = append(groups, gin.H{
+			"group_id": g.ID,
+			"hits":     h.renderSearchResults(ctx, g.Hits, params.IncludePayload, params.ThumbnailSize),
+			"count":    len(g.Hits),
+		})
+		best = append(best, g.Hits[0])
+	}
+	body := gin.H{
+		"results":  h.renderSearchResults(ctx, best, params.IncludePayload, params.ThumbnailSize),
+		"groups":   groups,
+		"count":    len(groups),
+		"group_by": params.GroupBy,
+		"fusion":   params.Fusion,
+	}
+	if out.crop != nil {
+		body["crop"] = out.crop
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// searchFormOverhead is what a search form may hold besides the image.
+const searchFormOverhead = 1 << 20
+
+// parseSearchForm reads search parameters from multipart form fields.
+// filter and queries are JSON encoded. The body is capped at
+// UPLOAD_MAX_BYTES plus the other fields, so an oversized image is never
+// buffered.
+func (h *Handlers) parseSearchForm(c *gin.Context, p *searchParams) error {
+	if h.maxUploadBytes > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxUploadBytes+searchFormOverhead)
+	}
+	file, _, err := c.Request.FormFile("image")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("%w: limit is %d bytes", errFileTooLarge, h.maxUploadBytes)
+	}
+	if err == nil {
+		defer file.Close()
+		if p.upload, err = h.readLimited(file); err != nil {
+			if isLimitError(err) {
+				return err
+			}
+			return fmt.Errorf("%w: failed to read image", errBadQuery)
+		}
+	}
+
+	p.ImageID = c.PostForm("image_id")
+	p.ImageURL = c.PostForm("image_url")
+	p.TextQuery = c.PostForm("text_query")
+	p.NegativeText = c.PostForm("negative_text")
+	p.Fusion = c.PostForm("fusion")
+	p.GroupBy = c.PostForm("group_by")
+
+	if v := c.PostForm("limit"); v != "" {
+		if p.Limit, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("%w: limit must be an integer", errBadQuery)
+		}
+	}
+	if v := c.PostForm("group_size"); v != "" {
+		if p.GroupSize, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("%w: group_size must be an integer", errBadQuery)
+		}
+	}
+	if v := c.PostForm("diversity"); v != "" {
+		if p.Diversity, err = strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("%w: diversity must be a number", errBadQuery)
+		}
+	}
+	if v := c.PostForm("score_threshold"); v != "" {
+		t, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return fmt.Errorf("%w: score_threshold must be a number", errBadQuery)
+		}
+		t32 := float32(t)
+		p.ScoreThreshold = &t32
+	}
+	if v := c.PostForm("phash_gate"); v != "" {
+		g, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%w: phash_gate must be an integer", errBadQuery)
+		}
+		p.PhashGate = &g
+	}
+	if v := c.PostForm("include_payload"); v != "" {
+		if p.IncludePayload, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%w: include_payload must be a boolean", errBadQuery)
+		}
+	}
+	if v := c.PostForm("thumbnail_size"); v != "" {
+		if p.ThumbnailSize, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("%w: thumbnail_size must be an integer", errBadQuery)
+		}
+	}
+	if v := c.PostForm("use_crops"); v != "" {
+		p.UseCrops, _ = strconv.ParseBool(v)
+	}
+	if v := c.PostForm("filter"); v != "" {
+		if err := json.Unmarshal([]byte(v), &p.Filter); err != nil {
+			return fmt.Errorf("%w: filter must be a JSON object", errBadQuery)
+		}
+	}
+	if v := c.PostForm("bbox"); v != "" {
+		if err := json.Unmarshal([]byte(v), &p.BBox); err != nil {
+			return fmt.Errorf("%w: bbox must be a JSON object", errBadQuery)
+		}
+	}
+	if v := c.PostForm("queries"); v != "" {
+		if err := json.Unmarshal([]byte(v), &p.Queries); err != nil {
+			return fmt.Errorf("%w: queries must be a JSON array", errBadQuery)
+		}
+	}
+	return nil
+}
+
+// normalize applies defaults and validates the parameters.
+func (p *searchParams) normalize() error {
+	if p.Limit <= 0 {
+		p.Limit = 10
+	}
+	if p.Limit > 100 {
+		p.Limit = 100
+	}
+	if p.Fusion == "" {
+		p.Fusion = "weighted"
+	}
+	if p.Fusion != "weighted" && p.Fusion != "rrf" {
+		return fmt.Errorf("%w: fusion must be weighted or rrf", errBadQuery)
+	}
+	if p.PhashGate != nil && *p.PhashGate < 0 {
+		return fmt.Errorf("%w: phash_gate must not be negative", errBadQuery)
+	}
+	if p.ThumbnailSize < 0 {
+		return fmt.Errorf("%w: thumbnail_size must not be negative", errBadQuery)
+	}
+	if p.BBox != nil {
+		if err := p.BBox.validate(); err != nil {
+			return err
+		}
+		if p.upload == nil && p.ImageURL == "" && p.ImageID == "" {
+			return fmt.Errorf("%w: bbox requires an uploaded image, image_url or image_id", errBadQuery)
+		}
+	}
+	if p.Diversity < 0 || p.Diversity > 1 {
+		return fmt.Errorf("%w: diversity must be between 0 and 1", errBadQuery)
+	}
+	if p.GroupBy != "" {
+		if p.Diversity > 0 {
+			return fmt.Errorf("%w: group_by cannot be combined with diversity", errBadQuery)
+		}
+		if !groupByPattern.MatchString(p.GroupBy) {
+			return fmt.Errorf("%w: group_by must be a payload field name", errBadQuery)
+		}
+		if p.Fusion == "rrf" {
+			return fmt.Errorf("%w: group_by cannot be combined with rrf fusion", errBadQuery)
+		}
+		if p.GroupSize <= 0 {
+			p.GroupSize = 3
+		}
+		if p.GroupSize > 20 {
+			p.GroupSize = 20
+		}
+	}
+	return nil
+}
+
+// inputs collects the query inputs. The upload, image_url, image_id,
+// text_query and negative_text are shorthands for entries of queries.
+func (p *searchParams) inputs() []queryInput {
+	inputs := append([]queryInput(nil), p.Queries...)
+	if p.upload != nil {
+		inputs = append(inputs, queryInput{upload: p.upload})
+	}
+	if p.ImageURL != "" {
+		inputs = append(inputs, queryInput{ImageURL: p.ImageURL})
+	}
+	if p.ImageID != "" {
+		inputs = append(inputs, queryInput{ImageID: p.ImageID})
+	}
+	if p.TextQuery != "" {
+		inputs = append(inputs, queryInput{Text: p.TextQuery})
+	}
+	if p.NegativeText != "" {
+		negative := -1.0
+		inputs = append(inputs, queryInput{Text: p.NegativeText, Weight: &negative})
+	}
+	return inputs
+}
+
+// runSearch embeds the query inputs, searches, applies the pHash gate and,
+// with diversity, re-ranks the candidates with maximal marginal relevance.
+func (h *Handlers) runSearch(ctx context.Context, p *searchParams) (*searchOutput, error) {
+	inputs := p.inputs()
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("%w: image, image_url, image_id, text_query or queries required", errBadQuery)
+	}
+	if err := h.fetchQueryInputs(ctx, inputs); err != nil {
+		return nil, err
+	}
+
+	var crop map[string]interface{}
+	if p.BBox != nil {
+		// The bbox applies to the uploaded image, else image_url, else
+		// image_id; they are collected after queries in that order, and
+		// fetched URLs are uploads by now.
+		for i := len(p.Queries); i < len(inputs); i++ {
+			if inputs[i].upload != nil || inputs[i].ImageID != "" {
+				var err error
+				if crop, err = h.cropQueryInput(ctx, &inputs[i], p.BBox); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+
+	if err := h.embedQueryInputs(ctx, inputs); err != nil {
+		return nil, err
+	}
+
+	var gate []*goimagehash.ImageHash
+	if p.PhashGate != nil {
+		for _, in := range inputs {
+			if in.phash != nil && in.weight() > 0 {
+				gate = append(gate, in.phash)
+			}
+		}
+		if len(gate) == 0 {
+			return nil, fmt.Errorf("%w: phash_gate requires an image query", errBadQuery)
+		}
+	}
+
+	// No user filtering for learning project
+	searchReq := qdrant.SearchRequest{
+		Filter: p.Filter,
+		Limit:  p.Limit,
+		// The payload carries the storage key and the pHash.
+		WithPayload: true,
+		Threshold:   p.ScoreThreshold,
+	}
+
+	if p.GroupBy != "" {
+		out, err := h.runGroupSearch(ctx, p, composeWeighted(inputs), searchReq, gate)
+		if err != nil {
+			return nil, err
+		}
+		out.crop = crop
+		return out, nil
+	}
+
+	if gate != nil || p.Diversity > 0 {
+		// Over-fetch: the gate drops visually different results and MMR
+		// needs alternatives to the near-duplicates at the top.
+		searchReq.Limit = p.Limit * mmrOverfetch
+		searchReq.WithVector = p.Diversity > 0
+	}
+
+	var results []qdrant.SearchResult
+	var err error
+	if p.Fusion == "rrf" && len(inputs) > 1 {
+		results, err = h.fuseRRF(ctx, inputs, searchReq)
+	} else {
+		searchReq.Vector = composeWeighted(inputs)
+		results, err = h.qdrant.Search(ctx, searchReq)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if gate != nil {
+		results = phashGate(results, gate, *p.PhashGate)
+	}
+	if p.Diversity > 0 {
+		results = rerankMMR(results, 1-p.Diversity, p.Limit)
+	}
+	if len(results) > p.Limit {
+		results = results[:p.Limit]
+	}
+	return &searchOutput{results: results, crop: crop}, nil
+}
+
+// runGroupSearch searches with Qdrant's grouping API. The pHash gate applies
+// to the hits of every group; groups left empty are dropped.
+func (h *Handlers) runGroupSearch(ctx context.Context, p *searchParams, vector []float32, base qdrant.SearchRequest, gate []*goimagehash.ImageHash) (*searchOutput, error) {
+	req := qdrant.GroupSearchRequest{
+		Vector:      vector,
+		Filter:      base.Filter,
+		GroupBy:     p.GroupBy,
+		GroupSize:   p.GroupSize,
+		Limit:       p.Limit,
+		WithPayload: true,
+		Threshold:   base.Threshold,
+	}
+	if gate != nil {
+		req.GroupSize = p.GroupSize * 5
+	}
+	groups, err := h.qdrant.SearchGroups(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := groups[:0]
+	for _, g := range groups {
+		if gate != nil {
+			g.Hits = phashGate(g.Hits, gate, *p.PhashGate)
+			if len(g.Hits) > p.GroupSize {
+				g.Hits = g.Hits[:p.GroupSize]
+			}
+		}
+		if len(g.Hits) > 0 {
+			kept = append(kept, g)
+		}
+	}
+	return &searchOutput{groups: kept}, nil
+}
+
+// phashGate keeps the results whose perceptual hash is within maxDistance
+// bits of one of the query hashes.
+func phashGate(results []qdrant.SearchResult, gate []*goimagehash.ImageHash, maxDistance int) []qdrant.SearchResult {
+	kept := results[:0]
+	for _, r := range results {
+		s, ok := r.Payload["phash"].(string)
+		if !ok {
+			continue
+		}
+		hash, err := goimagehash.ImageHashFromString(s)
+		if err != nil {
+			continue
+		}
+		for _, g := range gate {
+			if d, err := g.Distance(hash); err == nil && d <= maxDistance {
+				kept = append(kept, r)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// uploadPhash computes the perceptual hash of uploaded image bytes.
+func uploadPhash(data []byte) (*goimagehash.ImageHash, error) {
+	img, _, err := imaging.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return goimagehash.PerceptionHash(img)
+}
+
+// respondSearchError maps pipeline errors to status codes. Client errors
+// carry their message; upstream failures are logged and reported generically.
+func respondSearchError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errBadQuery):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errImageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case isLimitError(err):
+		respondLimitError(c, err)
+	case errors.Is(err, errEmbedding):
+		slog.Error("Search: embedding failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": errEmbedding.Error()})
+	default:
+		slog.Error("Search failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "search failed"})
+	}
+}
+
+// renderSearchResults turns search hits into the response items shared by
+// the search endpoints.
+func (h *Handlers) renderSearchResults(ctx context.Context, results []qdrant.SearchResult, includePayload bool, thumbSize int) []gin.H {
+	srcs := make([]thumbnailSource, len(results))
+	for i, result := range results {
+		srcs[i] = thumbnailSource{ID: result.ID, Payload: result.Payload}
+	}
+	thumbURLs := h.thumbnailURLs(ctx, srcs, thumbSize)
+
+	response := make([]gin.H, 0, len(results))
+	for i, result := range results {
+		item := gin.H{
+			"image_id": fmt.Sprintf("%v", result.ID),
+			"score":    result.Score,
+		}
+		if includePayload {
+			item["payload"] = result.Payload
+		}
+		if _, ok := result.Payload["key"].(string); ok {
+			item["preview_url"] = h.contentURL(result.ID, "content", 0)
+			item["thumbnail_url"] = thumbURLs[i]
+		}
+		response = append(response, item)
+	}
+	return response
+}
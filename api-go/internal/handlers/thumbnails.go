@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/visual-anomaly/api-go/internal/imaging"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+	"github.com/visual-anomaly/api-go/internal/storage"
+)
+
+var defaultThumbnailSizes = []int{128, 256, 1024}
+
+// parseThumbnailSizes parses THUMBNAIL_SIZES, a comma separated list of
+// bounding box sizes in pixels.
+func parseThumbnailSizes(v string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 16 || n > 4096 {
+			return nil, fmt.Errorf("invalid thumbnail size %q (want 16..4096)", f)
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no thumbnail sizes")
+	}
+	return sizes, nil
+}
+
+// storeThumbnails encodes and uploads every configured thumbnail size of img
+// and returns the payload fields describing them. Thumbnails are a
+// convenience, so failures are logged and the sizes that did upload are
+// returned.
+func (h *Handlers) storeThumbnails(ctx context.Context, userID, imageID string, img image.Image) map[string]interface{} {
+	thumbs, err := imaging.Thumbnails(img, h.thumbSizes, h.thumbFormat)
+	if err != nil {
+		slog.Error("Failed to generate thumbnails", "error", err, "image_id", imageID)
+		return nil
+	}
+
+	keys := map[string]interface{}{}
+	for _, t := range thumbs {
+		key := storage.GenerateThumbnailKey(userID, imageID, t.Size, h.thumbFormat.Ext)
+		if err := h.storage.UploadFile(ctx, key, t.Data, h.thumbFormat.ContentType); err != nil {
+			slog.Error("Failed to upload thumbnail", "error", err, "key", key)
+			continue
+		}
+		keys[strconv.Itoa(t.Size)] = key
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return map[string]interface{}{
+		"thumbnails":       keys,
+		"thumbnail_format": h.thumbFormat.Name,
+	}
+}
+
+// thumbnailKeys returns the object keys in a point's thumbnails payload.
+func thumbnailKeys(payload map[string]interface{}) []string {
+	m, _ := payload["thumbnails"].(map[string]interface{})
+	keys := make([]string, 0, len(m))
+	for _, v := range m {
+		if k, ok := v.(string); ok && k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (h *Handlers) deleteThumbnails(ctx context.Context, payload map[string]interface{}) {
+	for _, key := range thumbnailKeys(payload) {
+		if err := h.storage.DeleteFile(ctx, key); err != nil {
+			slog.Error("Failed to delete thumbnail", "error", err, "key", key)
+		}
+	}
+}
+
+// defaultThumbnailSize is the thumbnail served in list and search responses
+// when the request does not ask for a size.
+const defaultThumbnailSize = 256
+
+// Missing thumbnails are generated in the background by
+// lazyThumbnailWorkers workers, or by the thumbnail request when it comes
+// first. At most lazyThumbnailQueue points wait; points that do not fit
+// are queued again when next listed. A point whose generation failed is
+// not retried for lazyThumbnailRetry, and at most lazyThumbnailFailures
+// failures are remembered.
+const (
+	lazyThumbnailWorkers  = 4
+	lazyThumbnailQueue    = 1000
+	lazyThumbnailRetry    = time.Hour
+	lazyThumbnailFailures = 10000
+)
+
+// thumbnailSize maps a requested size to a configured one: the smallest
+// size that is at least requested, or the largest.
+func (h *Handlers) thumbnailSize(requested int) int {
+	if requested <= 0 {
+		requested = defaultThumbnailSize
+	}
+	fit, largest := 0, 0
+	for _, s := range h.thumbSizes {
+		if s >= requested && (fit == 0 || s < fit) {
+			fit = s
+		}
+		if s > largest {
+			largest = s
+		}
+	}
+	if fit != 0 {
+		return fit
+	}
+	return largest
+}
+
+// thumbnailSource is a point whose thumbnail is wanted.
+type thumbnailSource struct {
+	ID      interface{}
+	Payload map[string]interface{}
+}
+
+// thumbnailURLs returns a signed URL of the thumbnail of the given size for
+// each source, or "" for points without an object. Missing thumbnails are
+// queued for generation and still get the thumbnail URL, which generates
+// them when requested first; only points whose generation failed get the
+// URL of their original.
+func (h *Handlers) thumbnailURLs(ctx context.Context, srcs []thumbnailSource, size int) []string {
+	size = h.thumbnailSize(size)
+	urls := make([]string, len(srcs))
+	for i, k := range h.resolveThumbnailKeys(ctx, srcs, size) {
+		if k == "" {
+			if orig, _ := srcs[i].Payload["key"].(string); orig == "" {
+				continue
+			}
+			if h.thumbnailsFailed(fmt.Sprint(srcs[i].ID)) {
+				urls[i] = h.contentURL(srcs[i].ID, "content", 0)
+				continue
+			}
+		}
+		urls[i] = h.contentURL(srcs[i].ID, "thumbnail", size)
+	}
+	return urls
+}
+
+// resolveThumbnailKeys returns the object key of the thumbnail of the given
+// size for each source, or "" when it is missing. Missing thumbnails of
+// points with an object are queued for generation.
+func (h *Handlers) resolveThumbnailKeys(ctx context.Context, srcs []thumbnailSource, size int) []string {
+	size = h.thumbnailSize(size)
+	keys := make([]string, len(srcs))
+	for i, src := range srcs {
+		if keys[i] = thumbnailKey(src.Payload, size); keys[i] == "" {
+			h.queueThumbnails(src)
+		}
+	}
+	return keys
+}
+
+// thumbnailURL is thumbnailURLs for a single point.
+func (h *Handlers) thumbnailURL(ctx context.Context, id interface{}, payload map[string]interface{}, size int) string {
+	return h.thumbnailURLs(ctx, []thumbnailSource{{ID: id, Payload: payload}}, size)[0]
+}
+
+func thumbnailKey(payload map[string]interface{}, size int) string {
+	m, _ := payload["thumbnails"].(map[string]interface{})
+	k, _ := m[strconv.Itoa(size)].(string)
+	return k
+}
+
+// thumbnailJob generates the thumbnails of one point. It is queued for the
+// workers; whoever starts it first, a worker or a thumbnail request, runs
+// it, and later requests wait for it.
+type thumbnailJob struct {
+	src     thumbnailSource
+	started bool
+	done    chan struct{}
+	// fields are the payload fields of the thumbnails, nil when generation
+	// failed; set before done is closed.
+	fields map[string]interface{}
+}
+
+// newThumbnailJob copies the payload fields generation needs, as callers
+// go on to use theirs. It reports false for points without an object.
+func newThumbnailJob(src thumbnailSource) (*thumbnailJob, bool) {
+	key, _ := src.Payload["key"].(string)
+	if key == "" {
+		return nil, false
+	}
+	job := &thumbnailJob{
+		src:  thumbnailSource{ID: src.ID, Payload: map[string]interface{}{"key": key}},
+		done: make(chan struct{}),
+	}
+	for _, k := range []string{"owner_user_id", "image_id"} {
+		job.src.Payload[k] = src.Payload[k]
+	}
+	return job, true
+}
+
+// thumbnailsFailed reports whether generating the thumbnails of a point
+// failed within lazyThumbnailRetry.
+func (h *Handlers) thumbnailsFailed(id string) bool {
+	h.thumbMu.Lock()
+	defer h.thumbMu.Unlock()
+	return h.failedRecentlyLocked(id)
+}
+
+func (h *Handlers) failedRecentlyLocked(id string) bool {
+	failed, ok := h.thumbFailed[id]
+	if ok && time.Since(failed) >= lazyThumbnailRetry {
+		delete(h.thumbFailed, id)
+		return false
+	}
+	return ok
+}
+
+// queueThumbnails schedules generating the thumbnails of a point, unless it
+// is already pending, failed recently or has no object.
+func (h *Handlers) queueThumbnails(src thumbnailSource) {
+	id := fmt.Sprint(src.ID)
+	h.thumbMu.Lock()
+	defer h.thumbMu.Unlock()
+	if h.thumbPending[id] != nil || h.failedRecentlyLocked(id) {
+		return
+	}
+	job, ok := newThumbnailJob(src)
+	if !ok {
+		return
+	}
+	select {
+	case h.thumbQueue <- job:
+		h.thumbPending[id] = job
+	default:
+	}
+}
+
+// ensureThumbnails returns the payload fields of the thumbnails of a point,
+// generating them now unless that is already under way, in which case it
+// waits for it. It returns nil when generation fails, failed recently, or
+// ctx is done first.
+func (h *Handlers) ensureThumbnails(ctx context.Context, src thumbnailSource) map[string]interface{} {
+	id := fmt.Sprint(src.ID)
+	h.thumbMu.Lock()
+	if h.failedRecentlyLocked(id) {
+		h.thumbMu.Unlock()
+		return nil
+	}
+	job := h.thumbPending[id]
+	if job == nil {
+		var ok bool
+		if job, ok = newThumbnailJob(src); !ok {
+			h.thumbMu.Unlock()
+			return nil
+		}
+		h.thumbPending[id] = job
+	}
+	run := !job.started
+	job.started = true
+	h.thumbMu.Unlock()
+
+	if run {
+		h.runThumbnailJob(ctx, job)
+		return job.fields
+	}
+	select {
+	case <-job.done:
+		return job.fields
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// runThumbnails runs queued thumbnail jobs until ctx is done.
+func (h *Handlers) runThumbnails(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < lazyThumbnailWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-h.thumbQueue:
+					h.runQueuedThumbnailJob(ctx, job)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runQueuedThumbnailJob runs a job taken from the queue, unless a
+// thumbnail request has started it already.
+func (h *Handlers) runQueuedThumbnailJob(ctx context.Context, job *thumbnailJob) {
+	h.thumbMu.Lock()
+	run := !job.started
+	job.started = true
+	h.thumbMu.Unlock()
+	if run {
+		h.runThumbnailJob(ctx, job)
+	}
+}
+
+// runThumbnailJob generates and records the thumbnails of a started job.
+// Failures are remembered, unless ctx was cancelled.
+func (h *Handlers) runThumbnailJob(ctx context.Context, job *thumbnailJob) {
+	id := fmt.Sprint(job.src.ID)
+	fields, err := h.createThumbnails(ctx, job.src)
+	h.thumbMu.Lock()
+	delete(h.thumbPending, id)
+	if err != nil && ctx.Err() == nil {
+		h.recordThumbnailFailureLocked(id)
+	}
+	job.fields = fields
+	h.thumbMu.Unlock()
+	close(job.done)
+	if err != nil {
+		slog.Error("Lazy thumbnail: generation failed", "error", err, "point_id", id)
+	}
+}
+
+// recordThumbnailFailureLocked remembers a failure, first dropping expired
+// ones and then arbitrary ones to stay within lazyThumbnailFailures.
+func (h *Handlers) recordThumbnailFailureLocked(id string) {
+	if len(h.thumbFailed) >= lazyThumbnailFailures {
+		for k, t := range h.thumbFailed {
+			if time.Since(t) >= lazyThumbnailRetry {
+				delete(h.thumbFailed, k)
+			}
+		}
+	}
+	for k := range h.thumbFailed {
+		if len(h.thumbFailed) < lazyThumbnailFailures {
+			break
+		}
+		delete(h.thumbFailed, k)
+	}
+	h.thumbFailed[id] = time.Now()
+}
+
+func (h *Handlers) createThumbnails(ctx context.Context, src thumbnailSource) (map[string]interface{}, error) {
+	key, _ := src.Payload["key"].(string)
+	img, err := h.decodeStored(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", key, err)
+	}
+	owner, _ := src.Payload["owner_user_id"].(string)
+	imageID, _ := src.Payload["image_id"].(string)
+	if imageID == "" {
+		imageID = fmt.Sprint(src.ID)
+	}
+	fields := h.storeThumbnails(ctx, owner, imageID, img)
+	if fields == nil {
+		return nil, errors.New("no thumbnail stored")
+	}
+	if err := h.qdrant.SetPayloads(ctx, map[interface{}]qdrant.Payload{src.ID: fields}); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/visual-anomaly/api-go/internal/imaging"
+	"github.com/visual-anomaly/api-go/internal/qdrant"
+)
+
+// newThumbnailHandlers returns handlers with a local store and a fake
+// Qdrant that records the payload updates it gets.
+func newThumbnailHandlers(t *testing.T) (*Handlers, *[]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var updates []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		updates = append(updates, string(body))
+		mu.Unlock()
+		w.Write([]byte(`{"status": "ok", "result": {}}`))
+	}))
+	t.Cleanup(srv.Close)
+	q, _ := qdrant.NewClient(srv.URL, "")
+	format, _ := imaging.LookupFormat("jpeg")
+	return &Handlers{
+		storage:       newTestStore(t),
+		qdrant:        q,
+		thumbFormat:   format,
+		thumbSizes:    []int{64},
+		thumbPending:  map[string]*thumbnailJob{},
+		thumbFailed:   map[string]time.Time{},
+		thumbQueue:    make(chan *thumbnailJob, 2),
+		publicURL:     "/api",
+		contentSecret: []byte("test-secret"),
+		contentURLTTL: time.Hour,
+	}, &updates
+}
+
+func TestThumbnailURLsQueueMissingThumbnails(t *testing.T) {
+	ctx := context.Background()
+	h, updates := newThumbnailHandlers(t)
+	if err := h.storage.UploadFile(ctx, "images/u/a", noisePNG(t, 200, 100), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	payload := map[string]interface{}{"key": "images/u/a", "owner_user_id": "u", "image_id": "A"}
+	srcs := []thumbnailSource{{ID: int64(1), Payload: payload}, {ID: int64(1), Payload: payload}}
+
+	urls := h.thumbnailURLs(ctx, srcs, 64)
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "/api/images/1/thumbnail?") {
+			t.Errorf("got %s, want the thumbnail URL while the thumbnail is generated", u)
+		}
+	}
+	if _, ok := payload["thumbnails"]; ok {
+		t.Error("caller's payload was changed")
+	}
+	if len(h.thumbQueue) != 1 {
+		t.Fatalf("queued %d jobs, want 1 for a point listed twice", len(h.thumbQueue))
+	}
+
+	h.runQueuedThumbnailJob(ctx, <-h.thumbQueue)
+	if ok, _ := h.storage.FileExists(ctx, "thumbnails/u/A/64.jpg"); !ok {
+		t.Error("thumbnail not stored")
+	}
+	if len(*updates) != 1 || !strings.Contains((*updates)[0], "thumbnails/u/A/64.jpg") {
+		t.Errorf("payload updates %v", *updates)
+	}
+	if h.thumbPending["1"] != nil {
+		t.Error("point still pending after generation")
+	}
+}
+
+func TestEnsureThumbnailsRunsQueuedJobOnce(t *testing.T) {
+	ctx := context.Background()
+	h, updates := newThumbnailHandlers(t)
+	if err := h.storage.UploadFile(ctx, "images/u/a", noisePNG(t, 200, 100), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	src := thumbnailSource{ID: int64(1), Payload: map[string]interface{}{"key": "images/u/a", "owner_user_id": "u", "image_id": "A"}}
+
+	h.resolveThumbnailKeys(ctx, []thumbnailSource{src}, 64)
+	fields := h.ensureThumbnails(ctx, src)
+	if thumbnailKey(fields, 64) != "thumbnails/u/A/64.jpg" {
+		t.Fatalf("ensureThumbnails returned %v", fields)
+	}
+	// The worker finds the job already done
+	h.runQueuedThumbnailJob(ctx, <-h.thumbQueue)
+	if len(*updates) != 1 {
+		t.Errorf("generated %d times, want 1", len(*updates))
+	}
+}
+
+func TestThumbnailsFallBackToOriginalAfterFailing(t *testing.T) {
+	ctx := context.Background()
+	h, updates := newThumbnailHandlers(t)
+	src := thumbnailSource{ID: int64(2), Payload: map[string]interface{}{"key": "images/u/missing"}}
+
+	h.resolveThumbnailKeys(ctx, []thumbnailSource{src}, 64)
+	h.runQueuedThumbnailJob(ctx, <-h.thumbQueue)
+	if len(*updates) != 0 {
+		t.Errorf("payload updated for a failed generation: %v", *updates)
+	}
+
+	if u := h.thumbnailURLs(ctx, []thumbnailSource{src}, 64)[0]; !strings.HasPrefix(u, "/api/images/2/content?") {
+		t.Errorf("got %s, want the original after a failure", u)
+	}
+	if len(h.thumbQueue) != 0 {
+		t.Error("failed point queued again immediately")
+	}
+	if fields := h.ensureThumbnails(ctx, src); fields != nil {
+		t.Errorf("failed point generated again immediately: %v", fields)
+	}
+
+	h.thumbFailed["2"] = time.Now().Add(-lazyThumbnailRetry)
+	h.resolveThumbnailKeys(ctx, []thumbnailSource{src}, 64)
+	if len(h.thumbQueue) != 1 {
+		t.Error("failed point not retried after lazyThumbnailRetry")
+	}
+}
+
+func TestThumbnailFailuresAreBounded(t *testing.T) {
+	h, _ := newThumbnailHandlers(t)
+	for i := 0; i < lazyThumbnailFailures; i++ {
+		h.thumbFailed[strconv.Itoa(i)] = time.Now()
+	}
+	h.thumbFailed["0"] = time.Now().Add(-lazyThumbnailRetry)
+
+	h.recordThumbnailFailureLocked("new")
+	if len(h.thumbFailed) != lazyThumbnailFailures {
+		t.Errorf("remembering %d failures, want %d", len(h.thumbFailed), lazyThumbnailFailures)
+	}
+	if _, ok := h.thumbFailed["0"]; ok {
+		t.Error("expired failure kept")
+	}
+	h.recordThumbnailFailureLocked("newer")
+	if len(h.thumbFailed) != lazyThumbnailFailures || !h.thumbnailsFailed("newer") {
+		t.Errorf("remembering %d failures, want %d including the newest", len(h.thumbFailed), lazyThumbnailFailures)
+	}
+}
@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
+	"github.com/visual-anomaly/api-go/internal/imaging"
+	"github.com/visual-anomaly/api-go/internal/storage"
+)
+
+// Multipart uploads send large images in parts, each PUT to its own
+// presigned URL. A failed part is simply sent again, and GetUpload hands out
+// fresh URLs for the parts still missing, so an upload can be resumed.
+// Uploads not completed within multipartTTL are aborted by
+// runUploadCleanup.
+
+const (
+	// minPartSize is the S3 minimum for every part but the last.
+	minPartSize = 5 << 20
+	// maxParts is the S3 maximum number of parts.
+	maxParts      = 10000
+	partURLExpiry = time.Hour
+)
+
+// multipart upload states
+const (
+	uploadUploading = "uploading"
+	uploadCompleted = "completed"
+	uploadAborted   = "aborted"
+	uploadExpired   = "expired"
+)
+
+type multipartUpload struct {
+	ImageID     string     `json:"image_id"`
+	Key         string     `json:"key"`
+	ContentType string     `json:"content_type"`
+	Size        int64      `json:"size"`
+	PartSize    int64      `json:"part_size"`
+	PartCount   int        `json:"part_count"`
+	State       string     `json:"state"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	uploadID string
+}
+
+const multipartUploadColumns = `image_id, object_key, upload_id, content_type, size_bytes, part_size, state, created_at, expires_at, completed_at`
+
+func scanMultipartUpload(row interface{ Scan(...any) error }) (*multipartUpload, error) {
+	var u multipartUpload
+	var completedAt sql.NullTime
+	err := row.Scan(&u.ImageID, &u.Key, &u.uploadID, &u.ContentType, &u.Size, &u.PartSize, &u.State, &u.CreatedAt, &u.ExpiresAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+	if completedAt.Valid {
+		u.CompletedAt = &completedAt.Time
+	}
+	u.PartCount = int((u.Size + u.PartSize - 1) / u.PartSize)
+	return &u, nil
+}
+
+// partSize returns the size of part n (from 1); the last part is shorter.
+func (u *multipartUpload) partSize(n int) int64 {
+	if n == u.PartCount {
+		return u.Size - int64(u.PartCount-1)*u.PartSize
+	}
+	return u.PartSize
+}
+
+// uploadContentType returns the content type an upload of fileName,
+// declared as contentType (optional), is pinned to. It must be a decodable
+// format. It writes the error response when it returns false.
+func uploadContentType(c *gin.Context, fileName, contentType string) (string, bool) {
+	format := imaging.FormatForFileName(fileName)
+	if contentType != "" {
+		format = imaging.FormatForContentType(contentType)
+	}
+	if !imaging.Supported(format) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":             "content type not allowed",
+			"code":              "UNSUPPORTED_FORMAT",
+			"supported_formats": imaging.SupportedFormats(),
+		})
+		return "", false
+	}
+	return imaging.ContentType(format), true
+}
+
+// CreateUpload starts a multipart upload of size bytes and returns the
+// presigned URLs of its parts. Once every part is uploaded, the client
+// calls CompleteUpload and then ingests bucket and key as usual.
+func (h *Handlers) CreateUpload(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		FileName    string `json:"file_name" binding:"required"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	contentType, ok := uploadContentType(c, req.FileName, req.ContentType)
+	if !ok {
+		return
+	}
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if h.maxUploadBytes > 0 && req.Size > h.maxUploadBytes {
+		respondIngestError(c, fmt.Errorf("%w: %d bytes, limit is %d", errFileTooLarge, req.Size, h.maxUploadBytes))
+		return
+	}
+	if err := h.checkQuota(ctx, userID, req.Size); err != nil {
+		respondIngestError(c, err)
+		return
+	}
+
+	// Grow parts in whole MiB when the configured size needs too many
+	partSize := h.partSize
+	if n := (req.Size + partSize - 1) / partSize; n > maxParts {
+		partSize = ((req.Size+maxParts-1)/maxParts + 1<<20 - 1) / (1 << 20) * (1 << 20)
+	}
+
+	now := time.Now().UTC()
+	u := &multipartUpload{
+		ImageID:     ulid.Make().String(),
+		ContentType: contentType,
+		Size:        req.Size,
+		PartSize:    partSize,
+		State:       uploadUploading,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(h.multipartTTL),
+	}
+	u.Key = storage.GenerateImageKey(userID, u.ImageID)
+	u.PartCount = int((u.Size + u.PartSize - 1) / u.PartSize)
+
+	uploadID, err := h.storage.InitiateMultipart(ctx, u.Key, contentType)
+	if err != nil {
+		slog.Error("Failed to initiate multipart upload", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start upload"})
+		return
+	}
+	u.uploadID = uploadID
+
+	_, err = h.db.ExecContext(ctx, `
+		INSERT INTO multipart_uploads (image_id, user_id, object_key, upload_id, content_type, size_bytes, part_size, state, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, u.ImageID, userID, u.Key, u.uploadID, u.ContentType, u.Size, u.PartSize, u.State, u.CreatedAt, u.ExpiresAt)
+	if err != nil {
+		slog.Error("Failed to record multipart upload", "error", err)
+		_ = h.storage.AbortMultipart(ctx, u.Key, u.uploadID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start upload"})
+		return
+	}
+
+	parts, err := h.partURLs(ctx, u, nil)
+	if err != nil {
+		slog.Error("Failed to presign upload parts", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate presigned URL"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"upload": u,
+		"bucket": h.storage.Bucket(),
+		"parts":  parts,
+	})
+}
+
+// GetUpload returns the state of an upload. While it is in progress, it
+// lists the uploaded parts and fresh URLs for the missing ones, which is how
+// a client resumes.
+func (h *Handlers) GetUpload(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	u, ok := h.ownedUpload(c, userID)
+	if !ok {
+		return
+	}
+
+	resp := gin.H{"upload": u, "bucket": h.storage.Bucket()}
+	if u.State == uploadUploading {
+		ctx := c.Request.Context()
+		uploaded, err := h.storage.ListParts(ctx, u.Key, u.uploadID)
+		if err != nil {
+			slog.Error("Failed to list upload parts", "error", err, "image_id", u.ImageID)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load upload"})
+			return
+		}
+		done := map[int]bool{}
+		list := make([]gin.H, 0, len(uploaded))
+		for _, p := range uploaded {
+			done[p.PartNumber] = true
+			list = append(list, gin.H{"part_number": p.PartNumber, "size": p.Size, "etag": p.ETag})
+		}
+		parts, err := h.partURLs(ctx, u, done)
+		if err != nil {
+			slog.Error("Failed to presign upload parts", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate presigned URL"})
+			return
+		}
+		resp["uploaded_parts"] = list
+		resp["parts"] = parts
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// CompleteUpload assembles the parts into the image object. Every part must
+// be uploaded with its expected size.
+func (h *Handlers) CompleteUpload(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	u, ok := h.ownedUpload(c, userID)
+	if !ok || !uploadInProgress(c, u) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	uploaded, err := h.storage.ListParts(ctx, u.Key, u.uploadID)
+	if err != nil {
+		slog.Error("Failed to list upload parts", "error", err, "image_id", u.ImageID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to complete upload"})
+		return
+	}
+	byNumber := map[int]storage.Part{}
+	for _, p := range uploaded {
+		byNumber[p.PartNumber] = p
+	}
+	parts := make([]storage.Part, 0, u.PartCount)
+	missing, wrongSize := []int{}, []int{}
+	for n := 1; n <= u.PartCount; n++ {
+		p, ok := byNumber[n]
+		switch {
+		case !ok:
+			missing = append(missing, n)
+		case p.Size != u.partSize(n):
+			wrongSize = append(wrongSize, n)
+		default:
+			parts = append(parts, p)
+		}
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload has missing parts", "code": "UPLOAD_INCOMPLETE", "missing_parts": missing})
+		return
+	}
+	if len(wrongSize) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "parts have the wrong size", "code": "PART_SIZE_MISMATCH", "parts": wrongSize})
+		return
+	}
+
+	if err := h.storage.CompleteMultipart(ctx, u.Key, u.uploadID, parts); err != nil {
+		slog.Error("Failed to complete multipart upload", "error", err, "image_id", u.ImageID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to complete upload"})
+		return
+	}
+	now := time.Now().UTC()
+	u.State, u.CompletedAt = uploadCompleted, &now
+	if _, err := h.db.ExecContext(ctx, `UPDATE multipart_uploads SET state = $1, completed_at = $2 WHERE image_id = $3`, u.State, now, u.ImageID); err != nil {
+		slog.Error("Failed to record completed upload", "error", err, "image_id", u.ImageID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"upload": u, "bucket": h.storage.Bucket()})
+}
+
+// AbortUpload discards an upload in progress and its parts.
+func (h *Handlers) AbortUpload(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	u, ok := h.ownedUpload(c, userID)
+	if !ok || !uploadInProgress(c, u) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err := h.storage.AbortMultipart(ctx, u.Key, u.uploadID); err != nil {
+		slog.Error("Failed to abort multipart upload", "error", err, "image_id", u.ImageID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to abort upload"})
+		return
+	}
+	if _, err := h.db.ExecContext(ctx, `UPDATE multipart_uploads SET state = $1 WHERE image_id = $2`, uploadAborted, u.ImageID); err != nil {
+		slog.Error("Failed to record aborted upload", "error", err, "image_id", u.ImageID)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": uploadAborted})
+}
+
+// ownedUpload loads the upload of the :id parameter if it belongs to
+// userID. It writes the error response when it returns false.
+func (h *Handlers) ownedUpload(c *gin.Context, userID string) (*multipartUpload, bool) {
+	u, err := scanMultipartUpload(h.db.QueryRowContext(c.Request.Context(),
+		`SELECT `+multipartUploadColumns+` FROM multipart_uploads WHERE image_id = $1 AND user_id = $2`,
+		c.Param("id"), userID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load upload"})
+		return nil, false
+	}
+	return u, true
+}
+
+// uploadInProgress writes a conflict response for an upload that was
+// completed, aborted or has expired.
+func uploadInProgress(c *gin.Context, u *multipartUpload) bool {
+	switch {
+	case u.State == uploadExpired || (u.State == uploadUploading && time.Now().After(u.ExpiresAt)):
+		c.JSON(http.StatusGone, gin.H{"error": "upload expired", "code": "UPLOAD_EXPIRED"})
+		return false
+	case u.State != uploadUploading:
+		c.JSON(http.StatusConflict, gin.H{"error": "upload is " + u.State, "code": "UPLOAD_NOT_IN_PROGRESS"})
+		return false
+	}
+	return true
+}
+
+// partURLs presigns a PUT URL for every part not in done.
+func (h *Handlers) partURLs(ctx context.Context, u *multipartUpload, done map[int]bool) ([]gin.H, error) {
+	parts := make([]gin.H, 0, u.PartCount-len(done))
+	for n := 1; n <= u.PartCount; n++ {
+		if done[n] {
+			continue
+		}
+		url, err := h.storage.GetPresignedPartURL(ctx, u.Key, u.uploadID, n, partURLExpiry)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, gin.H{"part_number": n, "size": u.partSize(n), "url": url})
+	}
+	return parts, nil
+}
+
+// runUploadCleanup aborts abandoned multipart uploads every interval, until
+// ctx is cancelled.
+func (h *Handlers) runUploadCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := h.cleanupUploads(ctx); err != nil {
+			slog.Error("uploads: cleanup failed", "error", err)
+		}
+	}
+}
+
+// cleanupUploads aborts the multipart uploads under images/ started more
+// than multipartTTL ago, including any the database does not know of, and
+// marks the recorded ones expired.
+func (h *Handlers) cleanupUploads(ctx context.Context) error {
+	now := time.Now().UTC()
+	stale, err := h.storage.ListIncompleteUploads(ctx, "images/", now.Add(-h.multipartTTL))
+	if err != nil {
+		return err
+	}
+	for _, u := range stale {
+		if err := h.storage.AbortMultipart(ctx, u.Key, u.UploadID); err != nil {
+			slog.Error("uploads: abort failed", "error", err, "key", u.Key)
+			continue
+		}
+		slog.Info("uploads: aborted abandoned upload", "key", u.Key, "initiated", u.Initiated)
+	}
+
+	if h.db == nil {
+		return nil
+	}
+	_, err = h.db.ExecContext(ctx, `
+		UPDATE multipart_uploads SET state = $1
+		WHERE state = $2 AND expires_at < $3
+	`, uploadExpired, uploadUploading, now)
+	return err
+}
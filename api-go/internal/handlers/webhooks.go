@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/visual-anomaly/api-go/internal/fetch"
+	"github.com/visual-anomaly/api-go/internal/webhook"
+)
+
+type webhookSubscription struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	// Secret is only returned when the subscription is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+// CreateWebhook subscribes a URL to event types. Without a secret, a random
+// one is generated; either way it is returned only in this response.
+func (h *Handlers) CreateWebhook(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	var req struct {
+		URL    string   `json:"url" binding:"required"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err == nil {
+		err = fetch.CheckURL(u)
+	}
+	if err != nil || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL"})
+		return
+	}
+	if e, ok := webhook.ValidEvents(req.Events); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown event type: " + e, "events": webhook.Events})
+		return
+	}
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	if req.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate secret"})
+			return
+		}
+		req.Secret = hex.EncodeToString(b)
+	}
+
+	sub := webhookSubscription{URL: req.URL, Events: req.Events, Active: true, CreatedAt: time.Now().UTC(), Secret: req.Secret}
+	err = h.db.QueryRowContext(c.Request.Context(), `
+		INSERT INTO webhooks (user_id, url, secret, events, active, created_at)
+		VALUES ($1, $2, $3, $4, TRUE, $5)
+		RETURNING id
+	`, userID, sub.URL, sub.Secret, pq.Array(sub.Events), sub.CreatedAt).Scan(&sub.ID)
+	if err != nil {
+		slog.Error("Failed to create webhook", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create webhook"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, sub)
+}
+
+func (h *Handlers) ListWebhooks(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+
+	rows, err := h.db.QueryContext(c.Request.Context(), `
+		SELECT id, url, events, active, created_at FROM webhooks
+		WHERE user_id = $1 ORDER BY id
+	`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list webhooks"})
+		return
+	}
+	defer rows.Close()
+
+	subs := []webhookSubscription{}
+	for rows.Next() {
+		var sub webhookSubscription
+		if err := rows.Scan(&sub.ID, &sub.URL, pq.Array(&sub.Events), &sub.Active, &sub.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list webhooks"})
+			return
+		}
+		subs = append(subs, sub)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": subs, "count": len(subs), "event_types": webhook.Events})
+}
+
+func (h *Handlers) DeleteWebhook(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+
+	res, err := h.db.ExecContext(c.Request.Context(), `DELETE FROM webhooks WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete webhook"})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// UpdateWebhook turns a subscription on or off. Deactivating it cancels its
+// pending deliveries; reactivating it does not bring them back.
+func (h *Handlers) UpdateWebhook(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	var req struct {
+		Active *bool `json:"active" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var sub webhookSubscription
+	err = h.db.QueryRowContext(ctx, `
+		UPDATE webhooks SET active = $3 WHERE id = $1 AND user_id = $2
+		RETURNING id, url, events, active, created_at
+	`, id, userID, *req.Active).Scan(&sub.ID, &sub.URL, pq.Array(&sub.Events), &sub.Active, &sub.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to update webhook", "error", err, "webhook_id", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update webhook"})
+		return
+	}
+
+	var cancelled int64
+	if !sub.Active {
+		cancelled, err = h.webhooks.CancelPending(ctx, id)
+		if err != nil {
+			slog.Error("Failed to cancel webhook deliveries", "error", err, "webhook_id", id)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel pending deliveries"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": sub, "cancelled_deliveries": cancelled})
+}
+
+// ListWebhookDeliveries returns the delivery log of a subscription, newest
+// first, optionally filtered by status.
+func (h *Handlers) ListWebhookDeliveries(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+
+	id, ok := h.ownedWebhook(c, userID)
+	if !ok {
+		return
+	}
+	limit := queryInt(c, "limit", 50, 1, 200)
+	offset := queryInt(c, "offset", 0, 0, 1<<31-1)
+	status := c.Query("status")
+
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT id, event, payload, status, attempts, last_status_code, last_error, next_attempt_at, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4
+	`, id, status, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list deliveries"})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []gin.H{}
+	for rows.Next() {
+		var (
+			deliveryID             int64
+			event, payload, st     string
+			attempts               int
+			statusCode             *int
+			lastError              *string
+			nextAttempt, createdAt time.Time
+			deliveredAt            *time.Time
+		)
+		if err := rows.Scan(&deliveryID, &event, &payload, &st, &attempts, &statusCode, &lastError, &nextAttempt, &createdAt, &deliveredAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list deliveries"})
+			return
+		}
+		item := gin.H{
+			"id":               deliveryID,
+			"event":            event,
+			"payload":          json.RawMessage(payload),
+			"status":           st,
+			"attempts":         attempts,
+			"last_status_code": statusCode,
+			"last_error":       lastError,
+			"created_at":       createdAt,
+			"delivered_at":     deliveredAt,
+		}
+		if st == webhook.StatusPending {
+			item["next_attempt_at"] = nextAttempt
+		}
+		deliveries = append(deliveries, item)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries, "count": len(deliveries), "limit": limit, "offset": offset})
+}
+
+// RedeliverWebhook schedules a delivery for a fresh round of attempts.
+func (h *Handlers) RedeliverWebhook(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if h.db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNoDatabase.Error()})
+		return
+	}
+
+	id, ok := h.ownedWebhook(c, userID)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.ParseInt(c.Param("delivery_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+		return
+	}
+
+	found, err := h.webhooks.Redeliver(c.Request.Context(), id, deliveryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to schedule redelivery"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": webhook.StatusPending, "delivery_id": deliveryID})
+}
+
+// ownedWebhook parses the :id parameter and checks that the subscription
+// belongs to userID. It writes the error response when it returns false.
+func (h *Handlers) ownedWebhook(c *gin.Context, userID string) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return 0, false
+	}
+	var one int
+	err = h.db.QueryRowContext(c.Request.Context(), `SELECT 1 FROM webhooks WHERE id = $1 AND user_id = $2`, id, userID).Scan(&one)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load webhook"})
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/visual-anomaly/api-go/internal/webhook"
+)
+
+// fakeWebhookDB holds webhook 1 of user u and the statuses of its
+// deliveries, and understands only the statements UpdateWebhook and
+// CancelPending make.
+type fakeWebhookDB struct {
+	active     bool
+	deliveries []string
+}
+
+func (db *fakeWebhookDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeWebhookDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeWebhookDB }
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "UPDATE webhooks SET active") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	rows := &fakeRows{cols: []string{"id", "url", "events", "active", "created_at"}}
+	if args[0].Value == int64(1) && args[1].Value == "u" {
+		c.db.active = args[2].Value.(bool)
+		rows.vals = [][]driver.Value{{int64(1), "https://example.com/hook", []byte("{anomaly.flagged}"), c.db.active, time.Now()}}
+	}
+	return rows, nil
+}
+
+func (c fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.Contains(query, "UPDATE webhook_deliveries SET status") {
+		return nil, errors.New("unexpected statement: " + query)
+	}
+	var n int64
+	for i, st := range c.db.deliveries {
+		if args[0].Value == int64(1) && st == args[1].Value {
+			c.db.deliveries[i] = args[2].Value.(string)
+			n++
+		}
+	}
+	return driver.RowsAffected(n), nil
+}
+
+type fakeRows struct {
+	cols []string
+	vals [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.vals[0])
+	r.vals = r.vals[1:]
+	return nil
+}
+
+func TestUpdateWebhookCancelsPendingDeliveries(t *testing.T) {
+	fake := &fakeWebhookDB{active: true, deliveries: []string{webhook.StatusPending, webhook.StatusSucceeded, webhook.StatusPending}}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+	h := &Handlers{db: db, webhooks: webhook.NewDispatcher(db, nil)}
+
+	patch := func(user, id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPatch, "/webhooks/"+id, strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Params = gin.Params{{Key: "id", Value: id}}
+		c.Set("user_id", user)
+		h.UpdateWebhook(c)
+		return w
+	}
+
+	if w := patch("other", "1", `{"active": false}`); w.Code != http.StatusNotFound {
+		t.Errorf("another user's webhook: got %d, want 404", w.Code)
+	}
+	if w := patch("u", "1", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("no active: got %d, want 400", w.Code)
+	}
+	if !fake.active || fake.deliveries[0] != webhook.StatusPending {
+		t.Fatal("rejected requests changed the webhook")
+	}
+
+	w := patch("u", "1", `{"active": false}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Webhook   webhookSubscription `json:"webhook"`
+		Cancelled int64               `json:"cancelled_deliveries"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Webhook.Active || resp.Cancelled != 2 {
+		t.Errorf("got active %v, %d cancelled; want inactive, 2 cancelled", resp.Webhook.Active, resp.Cancelled)
+	}
+	want := []string{webhook.StatusCancelled, webhook.StatusSucceeded, webhook.StatusCancelled}
+	for i, st := range fake.deliveries {
+		if st != want[i] {
+			t.Errorf("delivery %d is %s, want %s", i, st, want[i])
+		}
+	}
+
+	if w := patch("u", "1", `{"active": true}`); w.Code != http.StatusOK || !fake.active {
+		t.Errorf("reactivating: got %d, active %v", w.Code, fake.active)
+	}
+	if fake.deliveries[0] != webhook.StatusCancelled {
+		t.Error("reactivating resumed a cancelled delivery")
+	}
+}
@@ -0,0 +1,74 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// avifQuality is avifenc's --qcolor/--qalpha, 0 (worst) to 100 (lossless).
+const avifQuality = "60"
+
+// avifFormat encodes AVIF with the avifenc command-line tool, since there is
+// no pure Go AVIF encoder.
+func avifFormat() (Format, error) {
+	path, err := exec.LookPath("avifenc")
+	if err != nil {
+		return Format{}, errors.New("thumbnail format avif needs avifenc (libavif) on PATH")
+	}
+	return Format{
+		Name:        "avif",
+		Ext:         "avif",
+		ContentType: "image/avif",
+		encode: func(w io.Writer, img image.Image) error {
+			return encodeAVIF(path, w, img)
+		},
+	}, nil
+}
+
+func encodeAVIF(avifenc string, w io.Writer, img image.Image) error {
+	dir, err := os.MkdirTemp("", "avif")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.avif")
+	f, err := os.Create(in)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), externalTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, avifenc, "--qcolor", avifQuality, "--qalpha", avifQuality, "--speed", "8", in, out)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("avifenc: timed out after %s", externalTimeout)
+		}
+		return fmt.Errorf("avifenc: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,374 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	_ "image/jpeg" // register decoder
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/bmp"  // register decoder
+	_ "golang.org/x/image/tiff" // register decoder
+	_ "golang.org/x/image/webp" // register decoder
+)
+
+// builtinFormats are the formats decoded in Go.
+var builtinFormats = []string{"jpeg", "png", "gif", "webp", "bmp", "tiff"}
+
+var (
+	externalMu      sync.Mutex
+	externalFormats []string
+)
+
+// UnsupportedFormatError is returned for images in a format that cannot be
+// decoded. Format names it when it is recognized, and is "unknown"
+// otherwise.
+type UnsupportedFormatError struct {
+	Format string
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("unsupported image format: %s (supported: %s)", e.Format, strings.Join(SupportedFormats(), ", "))
+}
+
+// SupportedFormats lists the formats that can be decoded.
+func SupportedFormats() []string {
+	externalMu.Lock()
+	defer externalMu.Unlock()
+	return append(append([]string(nil), builtinFormats...), externalFormats...)
+}
+
+// formatError turns image.ErrFormat into an UnsupportedFormatError.
+func formatError(data []byte, err error) error {
+	if errors.Is(err, image.ErrFormat) {
+		f := Sniff(data)
+		if f == "" {
+			f = "unknown"
+		}
+		return &UnsupportedFormatError{Format: f}
+	}
+	return err
+}
+
+// DecodeConfig is image.DecodeConfig with UnsupportedFormatError for
+// unknown formats.
+func DecodeConfig(data []byte) (image.Config, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	return cfg, format, formatError(data, err)
+}
+
+// externalDecoders decode formats with no Go decoder by converting them to
+// PNG with a command-line tool. Each tool is tried in order.
+var externalDecoders = []struct {
+	format string
+	magic  []string
+	tools  [][]string // command and arguments before "<input> <output>"
+}{
+	{"heic", []string{"????ftypheic", "????ftypheix", "????ftyphevc", "????ftyphevx", "????ftypmif1", "????ftypmsf1"}, [][]string{{"heif-dec"}, {"heif-convert"}}},
+	{"avif", []string{"????ftypavif", "????ftypavis"}, [][]string{{"avifdec"}}},
+}
+
+var enableOnce sync.Once
+
+// EnableExternalDecoders registers the HEIC and AVIF decoders whose tools
+// (libheif's heif-dec or heif-convert, libavif's avifdec) are on PATH, and
+// returns the formats it enabled. Only the first call has an effect.
+func EnableExternalDecoders() []string {
+	enableOnce.Do(func() {
+		for _, d := range externalDecoders {
+			var cmd []string
+			for _, t := range d.tools {
+				if path, err := exec.LookPath(t[0]); err == nil {
+					cmd = append([]string{path}, t[1:]...)
+					break
+				}
+			}
+			if cmd == nil {
+				continue
+			}
+			// The tool does the heavy lifting in its own process. The size
+			// comes from the file's own header, so that the pixel limit
+			// holds before the tool decodes anything.
+			decode := func(r io.Reader) (img image.Image, err error) {
+				err = decodeExternal(cmd, r, func(out io.Reader) (err error) {
+					img, err = png.Decode(out)
+					return err
+				})
+				return img, err
+			}
+			for _, m := range d.magic {
+				image.RegisterFormat(d.format, m, decode, heifConfig)
+			}
+			externalMu.Lock()
+			externalFormats = append(externalFormats, d.format)
+			externalMu.Unlock()
+		}
+	})
+	externalMu.Lock()
+	defer externalMu.Unlock()
+	return append([]string(nil), externalFormats...)
+}
+
+// externalTimeout bounds a single run of an external decoder or encoder.
+const externalTimeout = time.Minute
+
+// decodeExternal converts r to PNG with cmd and passes the result to read.
+func decodeExternal(cmd []string, r io.Reader, read func(io.Reader) error) error {
+	dir, err := os.MkdirTemp("", "decode")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out.png")
+	f, err := os.Create(in)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), externalTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	c := exec.CommandContext(ctx, cmd[0], append(cmd[1:], in, out)...)
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s: timed out after %s", filepath.Base(cmd[0]), externalTimeout)
+		}
+		return fmt.Errorf("%s: %w: %s", filepath.Base(cmd[0]), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	pf, err := os.Open(out)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+	return read(pf)
+}
+
+// Sniff names the format of an image file from its magic bytes, including
+// formats that cannot be decoded. It returns "" when the data is not
+// recognized as an image.
+func Sniff(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg"
+	case bytes.HasPrefix(data, pngMagic):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(data, []byte("BM")) && len(data) >= 26:
+		return "bmp"
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "tiff"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return sniffISOBMFF(data)
+	case bytes.HasPrefix(data, []byte{0xFF, 0x0A}) || bytes.HasPrefix(data, []byte("\x00\x00\x00\x0cJXL \r\n\x87\n")):
+		return "jxl"
+	case bytes.HasPrefix(data, []byte{0, 0, 1, 0}):
+		return "ico"
+	case bytes.HasPrefix(data, []byte("8BPS")):
+		return "psd"
+	}
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+		return "svg"
+	}
+	return ""
+}
+
+// sniffISOBMFF tells HEIC and AVIF apart by the brands of the ftyp box.
+func sniffISOBMFF(data []byte) string {
+	size := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if size < 16 || size > len(data) {
+		size = len(data)
+		if size > 64 {
+			size = 64
+		}
+	}
+	brands := map[string]bool{string(data[8:12]): true}
+	for i := 16; i+4 <= size; i += 4 {
+		brands[string(data[i:i+4])] = true
+	}
+	switch {
+	case brands["avif"] || brands["avis"]:
+		return "avif"
+	case brands["heic"] || brands["heix"] || brands["hevc"] || brands["hevx"] || brands["mif1"] || brands["msf1"]:
+		return "heic"
+	}
+	return ""
+}
+
+var contentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"bmp":  "image/bmp",
+	"tiff": "image/tiff",
+	"heic": "image/heic",
+	"avif": "image/avif",
+	"jxl":  "image/jxl",
+	"ico":  "image/vnd.microsoft.icon",
+	"psd":  "image/vnd.adobe.photoshop",
+	"svg":  "image/svg+xml",
+}
+
+// contentTypeAliases are other MIME types seen for the formats.
+var contentTypeAliases = map[string]string{
+	"image/jpg":           "jpeg",
+	"image/pjpeg":         "jpeg",
+	"image/x-png":         "png",
+	"image/x-ms-bmp":      "bmp",
+	"image/x-bmp":         "bmp",
+	"image/heif":          "heic",
+	"image/heic-sequence": "heic",
+	"image/heif-sequence": "heic",
+	"image/x-icon":        "ico",
+	"image/avif-sequence": "avif",
+}
+
+// FormatForContentType returns the format named by a MIME type, or "" when
+// the type is not one of the known image types.
+func FormatForContentType(contentType string) string {
+	ct := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	if f, ok := contentTypeAliases[ct]; ok {
+		return f
+	}
+	for f, t := range contentTypes {
+		if t == ct {
+			return f
+		}
+	}
+	return ""
+}
+
+// extensions maps file name extensions to formats.
+var extensions = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".jpe":  "jpeg",
+	".jfif": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".webp": "webp",
+	".bmp":  "bmp",
+	".dib":  "bmp",
+	".tif":  "tiff",
+	".tiff": "tiff",
+	".heic": "heic",
+	".heif": "heic",
+	".avif": "avif",
+	".jxl":  "jxl",
+	".ico":  "ico",
+	".psd":  "psd",
+	".svg":  "svg",
+}
+
+// FormatForFileName returns the format suggested by a file name's
+// extension, or "".
+func FormatForFileName(name string) string {
+	return extensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// Supported reports whether format can be decoded.
+func Supported(format string) bool {
+	for _, f := range SupportedFormats() {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentType returns the MIME type of a format named by Sniff.
+func ContentType(format string) string {
+	if ct, ok := contentTypes[format]; ok {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// GIFFrames decodes up to n frames of a GIF, evenly spaced over the
+// animation and composited as they are displayed, and returns them with the
+// total number of frames.
+func GIFFrames(data []byte, n int) ([]image.Image, int, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(g.Image)
+	if total == 0 {
+		return nil, 0, errors.New("gif has no frames")
+	}
+	if n < 1 {
+		n = 1
+	}
+	picked := map[int]bool{}
+	if n >= total {
+		for i := 0; i < total; i++ {
+			picked[i] = true
+		}
+	} else if n == 1 {
+		picked[0] = true
+	} else {
+		for i := 0; i < n; i++ {
+			picked[i*(total-1)/(n-1)] = true
+		}
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	if canvas.Rect.Empty() {
+		canvas = image.NewNRGBA(g.Image[0].Bounds())
+	}
+	frames := make([]image.Image, 0, len(picked))
+	for i, fr := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+		draw.Draw(canvas, fr.Bounds(), fr, fr.Bounds().Min, draw.Over)
+		if picked[i] {
+			frames = append(frames, cloneNRGBA(canvas))
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, fr.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, total, nil
+}
+
+func cloneNRGBA(m *image.NRGBA) *image.NRGBA {
+	c := *m
+	c.Pix = append([]uint8(nil), m.Pix...)
+	return &c
+}
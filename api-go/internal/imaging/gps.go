@@ -0,0 +1,131 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"regexp"
+)
+
+// gpsIFDTag is the IFD0 tag pointing at the GPS directory.
+const gpsIFDTag = 0x8825
+
+// tiffTypeSizes are the byte sizes of the TIFF field types 1 to 12.
+var tiffTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// xmpGPS matches GPS properties of an XMP packet in attribute or element
+// form.
+var xmpGPS = regexp.MustCompile(`(?s)\sexif:GPS\w+\s*=\s*("[^"]*"|'[^']*')|<exif:GPS\w+[^>]*/>|<exif:GPS\w+[^>]*>.*?</exif:GPS\w+>`)
+
+// StripGPS returns a copy of data with the GPS directory of its EXIF and
+// the GPS properties of its XMP blanked out, and whether anything was
+// removed. The edit is done in place so every container length stays valid;
+// the rest of the metadata, orientation included, is kept.
+func StripGPS(data []byte) ([]byte, bool) {
+	blocks := metadataBlocks(data)
+	if len(blocks) == 0 {
+		return data, false
+	}
+	out := append([]byte(nil), data...)
+	changed := false
+	for _, b := range blocks {
+		var c bool
+		switch b.kind {
+		case blockExif:
+			c = stripExifGPS(out[b.start:b.end])
+		case blockXMP:
+			c = stripXMPGPS(out[b.start:b.end])
+		}
+		if c && b.crc >= 0 {
+			fixPNGChunkCRC(out, b.crc)
+		}
+		changed = changed || c
+	}
+	if !changed {
+		return data, false
+	}
+	return out, true
+}
+
+// stripExifGPS empties the GPS directory of a TIFF structure: its values
+// are zeroed and its entry count set to 0.
+func stripExifGPS(t []byte) bool {
+	if len(t) < 8 {
+		return false
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+
+	ifd0 := int(order.Uint32(t[4:]))
+	if ifd0 < 8 || ifd0+2 > len(t) {
+		return false
+	}
+	gps := -1
+	n := int(order.Uint16(t[ifd0:]))
+	for i := 0; i < n; i++ {
+		e := ifd0 + 2 + i*12
+		if e+12 > len(t) {
+			return false
+		}
+		if order.Uint16(t[e:]) == gpsIFDTag {
+			gps = int(order.Uint32(t[e+8:]))
+			break
+		}
+	}
+	if gps < 8 || gps+2 > len(t) {
+		return false
+	}
+
+	n = int(order.Uint16(t[gps:]))
+	end := gps + 2 + n*12 + 4
+	if end > len(t) {
+		end = len(t)
+	}
+	for i := 0; i < n; i++ {
+		e := gps + 2 + i*12
+		if e+12 > len(t) {
+			break
+		}
+		typ := int(order.Uint16(t[e+2:]))
+		count := int(order.Uint32(t[e+4:]))
+		if typ < 1 || typ >= len(tiffTypeSizes) || count < 0 {
+			continue
+		}
+		size := tiffTypeSizes[typ] * count
+		if size <= 4 {
+			continue // stored in the entry itself
+		}
+		off := int(order.Uint32(t[e+8:]))
+		if off >= 0 && off+size <= len(t) && size > 0 {
+			clear(t[off : off+size])
+		}
+	}
+	// An IFD with no entries and no next IFD.
+	clear(t[gps:end])
+	return n > 0
+}
+
+// stripXMPGPS replaces GPS properties with spaces, which XMP allows
+// anywhere between properties.
+func stripXMPGPS(packet []byte) bool {
+	locs := xmpGPS.FindAllIndex(packet, -1)
+	for _, l := range locs {
+		copy(packet[l[0]:l[1]], bytes.Repeat([]byte(" "), l[1]-l[0]))
+	}
+	return len(locs) > 0
+}
+
+// fixPNGChunkCRC recomputes the CRC of the PNG chunk whose type starts at
+// typeAt.
+func fixPNGChunkCRC(data []byte, typeAt int) {
+	length := int(binary.BigEndian.Uint32(data[typeAt-4:]))
+	end := typeAt + 4 + length
+	binary.BigEndian.PutUint32(data[end:], crc32.ChecksumIEEE(data[typeAt:end]))
+}
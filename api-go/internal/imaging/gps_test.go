@@ -0,0 +1,228 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+func ascii(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func short(tag uint16, v uint16) tiffEntry {
+	return tiffEntry{tag, 3, 1, binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func long(tag uint16, v uint32) tiffEntry {
+	return tiffEntry{tag, 4, 1, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+// degrees is a GPS coordinate as three rationals.
+func degrees(tag uint16, d, m uint32) tiffEntry {
+	var b []byte
+	for _, v := range []uint32{d, 1, m, 1, 0, 1} {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	return tiffEntry{tag, 5, 3, b}
+}
+
+// buildTIFF lays out a little-endian TIFF with ifd0, a GPS directory
+// when gps is not empty, and pixels. The values of the GPS IFD pointer and
+// StripOffsets entries are filled in.
+func buildTIFF(ifd0, gps []tiffEntry, pixels []byte) []byte {
+	ifdSize := func(entries []tiffEntry) int { return 2 + 12*len(entries) + 4 }
+	gpsAt := 8 + ifdSize(ifd0)
+	data := gpsAt
+	if len(gps) > 0 {
+		data += ifdSize(gps)
+	}
+	pixelsAt := data
+	for _, e := range append(append([]tiffEntry(nil), ifd0...), gps...) {
+		if len(e.value) > 4 {
+			pixelsAt += len(e.value) + len(e.value)%2
+		}
+	}
+
+	out := []byte("II*\x00\x08\x00\x00\x00")
+	var values []byte
+	writeIFD := func(entries []tiffEntry) {
+		out = binary.LittleEndian.AppendUint16(out, uint16(len(entries)))
+		for _, e := range entries {
+			switch e.tag {
+			case gpsIFDTag:
+				e.value = binary.LittleEndian.AppendUint32(nil, uint32(gpsAt))
+			case 273: // StripOffsets
+				e.value = binary.LittleEndian.AppendUint32(nil, uint32(pixelsAt))
+			}
+			out = binary.LittleEndian.AppendUint16(out, e.tag)
+			out = binary.LittleEndian.AppendUint16(out, e.typ)
+			out = binary.LittleEndian.AppendUint32(out, e.count)
+			if len(e.value) <= 4 {
+				out = append(out, append(e.value, make([]byte, 4-len(e.value))...)...)
+				continue
+			}
+			out = binary.LittleEndian.AppendUint32(out, uint32(data+len(values)))
+			values = append(values, e.value...)
+			if len(e.value)%2 == 1 {
+				values = append(values, 0)
+			}
+		}
+		out = binary.LittleEndian.AppendUint32(out, 0)
+	}
+	writeIFD(ifd0)
+	if len(gps) > 0 {
+		writeIFD(gps)
+	}
+	return append(append(out, values...), pixels...)
+}
+
+// The camera, orientation and position every test file carries.
+var (
+	cameraEntries = []tiffEntry{ascii(0x010F, "Canon"), ascii(0x0110, "EOS R5"), short(0x0112, 6)}
+	gpsEntries    = []tiffEntry{ascii(1, "N"), degrees(2, 52, 30), ascii(3, "E"), degrees(4, 13, 24)}
+)
+
+func exifWithGPS() []byte {
+	return buildTIFF(append(append([]tiffEntry(nil), cameraEntries...), long(gpsIFDTag, 0)), gpsEntries, nil)
+}
+
+const xmpWithGPS = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description tiff:Make="Canon" tiff:Model="EOS R5" tiff:Orientation="6" exif:GPSLatitude="52,30.0N">` +
+	`<exif:GPSLongitude>13,24.0E</exif:GPSLongitude></rdf:Description></rdf:RDF></x:xmpmeta>`
+
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img
+}
+
+// withJPEGSegment inserts an APP1 segment after the SOI marker.
+func withJPEGSegment(t *testing.T, header string, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	seg := append([]byte(header), payload...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(seg)+2))
+	return bytes.Join([][]byte{buf.Bytes()[:2], app1, seg, buf.Bytes()[2:]}, nil)
+}
+
+// withPNGChunk inserts a chunk after IHDR.
+func withPNGChunk(t *testing.T, typ string, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(append(chunk, typ...), payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	ihdrEnd := len(pngMagic) + 8 + 13 + 4
+	return bytes.Join([][]byte{buf.Bytes()[:ihdrEnd], chunk, buf.Bytes()[ihdrEnd:]}, nil)
+}
+
+// withWebPChunk rewraps a lossless WebP as an extended one with the chunk.
+func withWebPChunk(t *testing.T, fourcc string, flag byte, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(buf.Bytes(), []byte("VP8L"))
+	if i < 0 {
+		t.Fatal("no VP8L chunk")
+	}
+	riffChunk := func(fourcc string, data []byte) []byte {
+		c := binary.LittleEndian.AppendUint32([]byte(fourcc), uint32(len(data)))
+		c = append(c, data...)
+		if len(data)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	b := testImage().Bounds()
+	vp8x := []byte{flag, 0, 0, 0, byte(b.Dx() - 1), 0, 0, byte(b.Dy() - 1), 0, 0}
+	body := bytes.Join([][]byte{[]byte("WEBP"), riffChunk("VP8X", vp8x), buf.Bytes()[i:], riffChunk(fourcc, payload)}, nil)
+	return append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+}
+
+func grayTIFF() []byte {
+	ifd0 := []tiffEntry{
+		short(256, 2), short(257, 2), short(258, 8), short(259, 1), short(262, 1),
+		ascii(0x010F, "Canon"), ascii(0x0110, "EOS R5"),
+		long(273, 0), short(0x0112, 6), short(277, 1), short(278, 2), long(279, 4),
+		long(gpsIFDTag, 0),
+	}
+	return buildTIFF(ifd0, gpsEntries, []byte{0, 64, 128, 255})
+}
+
+func TestStripGPS(t *testing.T) {
+	for _, tt := range []struct {
+		name, format string
+		data         []byte
+	}{
+		{"jpeg exif", "jpeg", withJPEGSegment(t, string(exifHeader), exifWithGPS())},
+		{"jpeg xmp", "jpeg", withJPEGSegment(t, string(xmpHeader), []byte(xmpWithGPS))},
+		{"png exif", "png", withPNGChunk(t, "eXIf", exifWithGPS())},
+		{"png xmp", "png", withPNGChunk(t, "iTXt", append([]byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"), xmpWithGPS...))},
+		{"webp exif", "webp", withWebPChunk(t, "EXIF", 0x08, exifWithGPS())},
+		{"webp xmp", "webp", withWebPChunk(t, "XMP ", 0x04, []byte(xmpWithGPS))},
+		{"tiff", "tiff", grayTIFF()},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before := ReadMetadata(tt.data)
+			if !before.HasGPS {
+				t.Fatalf("test file has no GPS: %+v", before)
+			}
+			out, changed := StripGPS(tt.data)
+			if !changed || len(out) != len(tt.data) {
+				t.Fatalf("changed %v, %d bytes from %d", changed, len(out), len(tt.data))
+			}
+			if !ReadMetadata(tt.data).HasGPS {
+				t.Error("input was modified")
+			}
+
+			after := ReadMetadata(out)
+			if after.HasGPS {
+				t.Errorf("GPS kept: %v, %v", after.Latitude, after.Longitude)
+			}
+			if after.Orientation != 6 || after.Make != "Canon" || after.Model != "EOS R5" {
+				t.Errorf("got %+v, want orientation and camera kept", after)
+			}
+			if _, format, err := image.Decode(bytes.NewReader(out)); err != nil || format != tt.format {
+				t.Errorf("decoding stripped file: %s, %v", format, err)
+			}
+		})
+	}
+}
+
+func TestStripGPSLeavesFilesWithoutGPS(t *testing.T) {
+	data := withJPEGSegment(t, string(exifHeader), buildTIFF(cameraEntries, nil, nil))
+	if out, changed := StripGPS(data); changed || !bytes.Equal(out, data) {
+		t.Error("file without GPS changed")
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	if _, changed := StripGPS(buf.Bytes()); changed {
+		t.Error("file without metadata changed")
+	}
+}
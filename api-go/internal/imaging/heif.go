@@ -0,0 +1,169 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// maxHEIFMeta bounds how much of a HEIF file is read looking for the meta
+// box, which encoders put before the image data.
+const maxHEIFMeta = 4 << 20
+
+var errNoHEIFSize = errors.New("heif: no image size in meta box")
+
+// heifConfig reads the size of the primary image of a HEIC or AVIF file
+// from its ispe (image spatial extents) property, without decoding it, so
+// that the pixel limit is enforced before an external tool sees the file.
+func heifConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxHEIFMeta))
+	if err != nil {
+		return image.Config{}, err
+	}
+	var meta []byte
+	for _, b := range isoBoxes(data) {
+		if b.typ == "meta" && len(b.body) >= 4 {
+			meta = b.body[4:]
+			break
+		}
+	}
+	if meta == nil {
+		return image.Config{}, errNoHEIFSize
+	}
+
+	var primary uint32
+	var props []isoBox
+	assoc := map[uint32][]int{}
+	for _, b := range isoBoxes(meta) {
+		switch b.typ {
+		case "pitm":
+			if len(b.body) >= 6 && b.body[0] == 0 {
+				primary = uint32(binary.BigEndian.Uint16(b.body[4:]))
+			} else if len(b.body) >= 8 {
+				primary = binary.BigEndian.Uint32(b.body[4:])
+			}
+		case "iprp":
+			for _, c := range isoBoxes(b.body) {
+				switch c.typ {
+				case "ipco":
+					props = isoBoxes(c.body)
+				case "ipma":
+					parseIPMA(c.body, assoc)
+				}
+			}
+		}
+	}
+
+	// The primary item's properties, or every property when the file does
+	// not say which image is primary
+	var picked []isoBox
+	if indexes, ok := assoc[primary]; ok {
+		for _, i := range indexes {
+			if i >= 1 && i <= len(props) {
+				picked = append(picked, props[i-1])
+			}
+		}
+	} else {
+		picked = props
+	}
+	var width, height uint32
+	var rotated bool
+	for _, p := range picked {
+		switch p.typ {
+		case "ispe":
+			if len(p.body) < 12 {
+				continue
+			}
+			// Without a primary item, the largest image is the one decoded
+			w, h := binary.BigEndian.Uint32(p.body[4:]), binary.BigEndian.Uint32(p.body[8:])
+			if uint64(w)*uint64(h) > uint64(width)*uint64(height) {
+				width, height = w, h
+			}
+		case "irot":
+			if len(p.body) >= 1 {
+				rotated = p.body[0]&1 == 1
+			}
+		}
+	}
+	if width == 0 || height == 0 || width > 1<<30 || height > 1<<30 {
+		return image.Config{}, errNoHEIFSize
+	}
+	if rotated {
+		width, height = height, width
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+// parseIPMA adds the 1-based property indexes of each item in an item
+// property association box to assoc.
+func parseIPMA(body []byte, assoc map[uint32][]int) {
+	if len(body) < 8 {
+		return
+	}
+	version, flags := body[0], body[3]
+	n := binary.BigEndian.Uint32(body[4:])
+	p := body[8:]
+	for ; n > 0; n-- {
+		var item uint32
+		if version < 1 {
+			if len(p) < 3 {
+				return
+			}
+			item, p = uint32(binary.BigEndian.Uint16(p)), p[2:]
+		} else {
+			if len(p) < 5 {
+				return
+			}
+			item, p = binary.BigEndian.Uint32(p), p[4:]
+		}
+		count := int(p[0])
+		p = p[1:]
+		for ; count > 0; count-- {
+			var index int
+			if flags&1 == 1 {
+				if len(p) < 2 {
+					return
+				}
+				index, p = int(binary.BigEndian.Uint16(p)&0x7FFF), p[2:]
+			} else {
+				if len(p) < 1 {
+					return
+				}
+				index, p = int(p[0]&0x7F), p[1:]
+			}
+			assoc[item] = append(assoc[item], index)
+		}
+	}
+}
+
+type isoBox struct {
+	typ  string
+	body []byte
+}
+
+// isoBoxes splits data into ISO base media file format boxes, stopping at
+// the first truncated one.
+func isoBoxes(data []byte) []isoBox {
+	var boxes []isoBox
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ, header := string(data[4:8]), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return boxes
+		}
+		boxes = append(boxes, isoBox{typ: typ, body: data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
@@ -0,0 +1,45 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func box(typ string, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(b)))
+	return append(append(out, typ...), b...)
+}
+
+func ispe(w, h uint32) []byte {
+	return box("ispe", []byte{0, 0, 0, 0}, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, w), h))
+}
+
+func TestHEIFConfigReadsPrimaryImageSize(t *testing.T) {
+	// Item 1 is a 512x512 tile, item 2 the 8000x6000 grid rotated by 90
+	// degrees; the mdat is truncated as it is in a peeked header.
+	heif := func(primary byte) []byte {
+		return bytes.Join([][]byte{
+			box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")),
+			box("meta", []byte{0, 0, 0, 0},
+				box("pitm", []byte{0, 0, 0, 0, 0, primary}),
+				box("iprp",
+					box("ipco", ispe(512, 512), ispe(8000, 6000), box("irot", []byte{1})),
+					box("ipma", []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 1, 1, 0x81, 0, 2, 2, 0x82, 3}))),
+			{0, 0, 0x10, 0, 'm', 'd', 'a', 't', 1, 2, 3},
+		}, nil)
+	}
+
+	cfg, err := heifConfig(bytes.NewReader(heif(2)))
+	if err != nil || cfg.Width != 6000 || cfg.Height != 8000 {
+		t.Errorf("grid: got %dx%d, %v, want 6000x8000", cfg.Width, cfg.Height, err)
+	}
+	cfg, err = heifConfig(bytes.NewReader(heif(1)))
+	if err != nil || cfg.Width != 512 || cfg.Height != 512 {
+		t.Errorf("tile: got %dx%d, %v, want 512x512", cfg.Width, cfg.Height, err)
+	}
+	if _, err := heifConfig(bytes.NewReader(box("ftyp", []byte("avif")))); err == nil {
+		t.Error("no error for a file without a meta box")
+	}
+}
@@ -0,0 +1,125 @@
+// Package imaging resizes images and encodes thumbnails.
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"sort"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+)
+
+// Format is an output format for thumbnails.
+type Format struct {
+	Name        string
+	Ext         string
+	ContentType string
+	encode      func(w io.Writer, img image.Image) error
+}
+
+// Encode writes img in the format.
+func (f Format) Encode(w io.Writer, img image.Image) error {
+	return f.encode(w, img)
+}
+
+var formats = map[string]Format{
+	"jpeg": {Name: "jpeg", Ext: "jpg", ContentType: "image/jpeg", encode: encodeJPEG},
+	// nativewebp writes lossless (VP8L) WebP.
+	"webp": {Name: "webp", Ext: "webp", ContentType: "image/webp", encode: func(w io.Writer, img image.Image) error {
+		return nativewebp.Encode(w, img, nil)
+	}},
+}
+
+// LookupFormat returns the named format. avif is only available when the
+// avifenc tool from libavif is installed.
+func LookupFormat(name string) (Format, error) {
+	if name == "avif" {
+		return avifFormat()
+	}
+	f, ok := formats[name]
+	if !ok {
+		names := make([]string, 0, len(formats)+1)
+		for n := range formats {
+			names = append(names, n)
+		}
+		names = append(names, "avif")
+		sort.Strings(names)
+		return Format{}, fmt.Errorf("unknown thumbnail format %q (want one of %v)", name, names)
+	}
+	return f, nil
+}
+
+func encodeJPEG(w io.Writer, img image.Image) error {
+	// JPEG has no alpha channel; flatten onto white instead of black.
+	if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+		b := img.Bounds()
+		flat := image.NewRGBA(b)
+		draw.Draw(flat, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, b, img, b.Min, draw.Over)
+		img = flat
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+}
+
+// Fit scales img down with Catmull-Rom resampling so that its longest side
+// is at most max. Images that already fit are returned unchanged.
+func Fit(img image.Image, max int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= max && h <= max {
+		return img
+	}
+	tw, th := max, h*max/w
+	if h > w {
+		tw, th = w*max/h, max
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	draw.CatmullRom.Scale(out, out.Bounds(), img, b, draw.Src, nil)
+	return out
+}
+
+// Thumbnail is one encoded size of an image.
+type Thumbnail struct {
+	// Size is the requested bounding box; Width and Height are the actual
+	// dimensions, which are smaller than Size for small images.
+	Size   int
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// Thumbnails encodes img fitted to each of sizes. Images are never
+// upscaled, so sizes larger than the image share one encoding.
+func Thumbnails(img image.Image, sizes []int, f Format) ([]Thumbnail, error) {
+	var native *Thumbnail
+	thumbs := make([]Thumbnail, 0, len(sizes))
+	for _, size := range sizes {
+		fitted := Fit(img, size)
+		b := fitted.Bounds()
+		if fitted == img && native != nil {
+			thumbs = append(thumbs, Thumbnail{Size: size, Width: native.Width, Height: native.Height, Data: native.Data})
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if err := f.Encode(buf, fitted); err != nil {
+			return nil, fmt.Errorf("encode %dpx %s thumbnail: %w", size, f.Name, err)
+		}
+		t := Thumbnail{Size: size, Width: b.Dx(), Height: b.Dy(), Data: buf.Bytes()}
+		if fitted == img {
+			native = &t
+		}
+		thumbs = append(thumbs, t)
+	}
+	return thumbs, nil
+}
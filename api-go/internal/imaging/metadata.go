@@ -0,0 +1,324 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Metadata is what ingest keeps of an image's EXIF and XMP.
+type Metadata struct {
+	// Orientation is the EXIF orientation, 1 to 8; 1 is upright.
+	Orientation int
+	Make        string
+	Model       string
+	Lens        string
+	// CapturedAt is the camera's wall clock time, which EXIF stores without
+	// a zone; it is reported as UTC. Zero when unknown.
+	CapturedAt time.Time
+	HasGPS     bool
+	Latitude   float64
+	Longitude  float64
+}
+
+// metadata block kinds
+const (
+	blockExif = iota
+	blockXMP
+)
+
+// block is an EXIF (TIFF structure) or XMP packet inside an image file.
+// data[start:end] is the block; crc, when not -1, is the offset of the PNG
+// chunk whose CRC covers it.
+type block struct {
+	kind       int
+	start, end int
+	crc        int
+}
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngMagic   = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// metadataBlocks finds the EXIF and XMP blocks of a JPEG, PNG, WebP or TIFF
+// file. Malformed files yield the blocks found before the damage.
+func metadataBlocks(data []byte) []block {
+	switch {
+	case len(data) > 4 && data[0] == 0xFF && data[1] == 0xD8:
+		return jpegBlocks(data)
+	case bytes.HasPrefix(data, pngMagic):
+		return pngBlocks(data)
+	case len(data) > 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return webpBlocks(data)
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		return []block{{kind: blockExif, start: 0, end: len(data), crc: -1}}
+	}
+	return nil
+}
+
+func jpegBlocks(data []byte) []block {
+	var blocks []block
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return blocks
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xD9 || marker == 0xDA { // end of image, start of scan
+			return blocks
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { // no length
+			i += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		start, end := i+4, i+2+length
+		if length < 2 || end > len(data) {
+			return blocks
+		}
+		if marker == 0xE1 {
+			seg := data[start:end]
+			switch {
+			case bytes.HasPrefix(seg, exifHeader):
+				blocks = append(blocks, block{kind: blockExif, start: start + len(exifHeader), end: end, crc: -1})
+			case bytes.HasPrefix(seg, xmpHeader):
+				blocks = append(blocks, block{kind: blockXMP, start: start + len(xmpHeader), end: end, crc: -1})
+			}
+		}
+		i = end
+	}
+	return blocks
+}
+
+func pngBlocks(data []byte) []block {
+	var blocks []block
+	i := len(pngMagic)
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		start, end := i+8, i+8+length
+		if length < 0 || end+4 > len(data) {
+			return blocks
+		}
+		switch typ {
+		case "eXIf":
+			blocks = append(blocks, block{kind: blockExif, start: start, end: end, crc: i + 4})
+		case "iTXt":
+			// keyword \0 compression-flag method language \0 translated \0 text
+			chunk := data[start:end]
+			const keyword = "XML:com.adobe.xmp\x00"
+			if bytes.HasPrefix(chunk, []byte(keyword)) && len(chunk) > len(keyword)+2 && chunk[len(keyword)] == 0 {
+				rest := len(keyword) + 2
+				if j := bytes.IndexByte(chunk[rest:], 0); j >= 0 {
+					rest += j + 1
+					if k := bytes.IndexByte(chunk[rest:], 0); k >= 0 {
+						rest += k + 1
+						blocks = append(blocks, block{kind: blockXMP, start: start + rest, end: end, crc: i + 4})
+					}
+				}
+			}
+		}
+		i = end + 4
+	}
+	return blocks
+}
+
+func webpBlocks(data []byte) []block {
+	var blocks []block
+	i := 12
+	for i+8 <= len(data) {
+		fourcc := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		start, end := i+8, i+8+length
+		if length < 0 || end > len(data) {
+			return blocks
+		}
+		switch fourcc {
+		case "EXIF":
+			s := start
+			if bytes.HasPrefix(data[start:end], exifHeader) {
+				s += len(exifHeader)
+			}
+			blocks = append(blocks, block{kind: blockExif, start: s, end: end, crc: -1})
+		case "XMP ":
+			blocks = append(blocks, block{kind: blockXMP, start: start, end: end, crc: -1})
+		}
+		i = end + length%2
+	}
+	return blocks
+}
+
+// ReadMetadata extracts orientation, camera, capture time and GPS position
+// from EXIF, falling back to XMP for fields EXIF lacks. Images without
+// metadata get an upright, otherwise empty Metadata.
+func ReadMetadata(data []byte) Metadata {
+	m := Metadata{Orientation: 1}
+	var xmp []byte
+	for _, b := range metadataBlocks(data) {
+		switch b.kind {
+		case blockExif:
+			readExif(data[b.start:b.end], &m)
+		case blockXMP:
+			if xmp == nil {
+				xmp = data[b.start:b.end]
+			}
+		}
+	}
+	if xmp != nil {
+		readXMP(xmp, &m)
+	}
+	if m.Orientation < 1 || m.Orientation > 8 {
+		m.Orientation = 1
+	}
+	return m
+}
+
+// readExif fills m from an EXIF block. goexif returns what it could parse
+// along with errors in optional directories, so only a nil result is fatal.
+func readExif(tiff []byte, m *Metadata) {
+	x, _ := exif.Decode(bytes.NewReader(tiff))
+	if x == nil {
+		return
+	}
+	if t, err := x.Get(exif.Orientation); err == nil {
+		if o, err := t.Int(0); err == nil {
+			m.Orientation = o
+		}
+	}
+	m.Make = exifString(x, exif.Make)
+	m.Model = exifString(x, exif.Model)
+	m.Lens = exifString(x, exif.LensModel)
+	for _, f := range []exif.FieldName{exif.DateTimeOriginal, exif.DateTime} {
+		if s := exifString(x, f); s != "" {
+			if t, err := time.Parse("2006:01:02 15:04:05", s); err == nil {
+				m.CapturedAt = t
+				break
+			}
+		}
+	}
+	if lat, lon, err := x.LatLong(); err == nil && validLatLon(lat, lon) {
+		m.HasGPS, m.Latitude, m.Longitude = true, lat, lon
+	}
+}
+
+func exifString(x *exif.Exif, f exif.FieldName) string {
+	t, err := x.Get(f)
+	if err != nil {
+		return ""
+	}
+	s, err := t.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func validLatLon(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180 && !(lat == 0 && lon == 0)
+}
+
+// readXMP fills the fields of m that EXIF left empty.
+func readXMP(packet []byte, m *Metadata) {
+	if m.Orientation == 1 {
+		if o, err := strconv.Atoi(xmpValue(packet, "tiff:Orientation")); err == nil {
+			m.Orientation = o
+		}
+	}
+	if m.Make == "" {
+		m.Make = xmpValue(packet, "tiff:Make")
+	}
+	if m.Model == "" {
+		m.Model = xmpValue(packet, "tiff:Model")
+	}
+	if m.Lens == "" {
+		m.Lens = xmpValue(packet, "exifEX:LensModel")
+	}
+	if m.CapturedAt.IsZero() {
+		for _, name := range []string{"exif:DateTimeOriginal", "xmp:CreateDate", "photoshop:DateCreated"} {
+			if t, ok := parseXMPDate(xmpValue(packet, name)); ok {
+				m.CapturedAt = t
+				break
+			}
+		}
+	}
+	if !m.HasGPS {
+		lat, ok1 := parseXMPCoordinate(xmpValue(packet, "exif:GPSLatitude"))
+		lon, ok2 := parseXMPCoordinate(xmpValue(packet, "exif:GPSLongitude"))
+		if ok1 && ok2 && validLatLon(lat, lon) {
+			m.HasGPS, m.Latitude, m.Longitude = true, lat, lon
+		}
+	}
+}
+
+// xmpValue returns a simple property of an XMP packet, written either as
+// an attribute (name="value") or as an element (<name>value</name>).
+func xmpValue(packet []byte, name string) string {
+	q := regexp.QuoteMeta(name)
+	re := regexp.MustCompile(`(?s)(?:\s` + q + `\s*=\s*["']([^"']*)["']|<` + q + `>([^<]*)</` + q + `>)`)
+	sm := re.FindSubmatch(packet)
+	if sm == nil {
+		return ""
+	}
+	v := sm[1]
+	if v == nil {
+		v = sm[2]
+	}
+	return strings.TrimSpace(string(v))
+}
+
+func parseXMPDate(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			if layout == time.RFC3339Nano {
+				// Keep the wall clock, as for EXIF.
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+			}
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseXMPCoordinate parses the XMP GPSCoordinate forms "DDD,MM,SSk" and
+// "DDD,MM.mmk", where k is N, S, E or W.
+func parseXMPCoordinate(s string) (float64, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	ref := s[len(s)-1]
+	parts := strings.Split(s[:len(s)-1], ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var v, scale float64 = 0, 1
+	for _, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return 0, false
+		}
+		v += f / scale
+		scale *= 60
+	}
+	switch ref {
+	case 'S', 'W', 's', 'w':
+		v = -v
+	case 'N', 'E', 'n', 'e':
+	default:
+		return 0, false
+	}
+	return v, true
+}
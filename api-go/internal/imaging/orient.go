@@ -0,0 +1,135 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+)
+
+// HeaderSize is how much of a stream Peek reads ahead. It covers the
+// metadata and image header of all but unusual JPEG, PNG and WebP files.
+const HeaderSize = 256 << 10
+
+// Peek returns up to the first HeaderSize bytes of r, to inspect the format
+// and metadata, and a reader that still yields the whole stream.
+func Peek(r io.Reader) ([]byte, io.Reader) {
+	br := bufio.NewReaderSize(r, HeaderSize)
+	head, _ := br.Peek(HeaderSize)
+	return head, br
+}
+
+// DecodeFrom decodes an image from r, whose first bytes are head as
+// returned by Peek, and turns it upright. Only the decoded image is held in
+// memory, except by decoders that need the whole file (TIFF, HEIC, AVIF).
+// The orientation is read from head, so metadata placed after it, as TIFF
+// allows, is not seen.
+func DecodeFrom(r io.Reader, head []byte) (image.Image, string, error) {
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", formatError(head, err)
+	}
+	return Orient(img, ReadMetadata(head).Orientation), format, nil
+}
+
+// DecodeReader is DecodeFrom for a stream that was not peeked at.
+func DecodeReader(r io.Reader) (image.Image, string, error) {
+	head, r := Peek(r)
+	return DecodeFrom(r, head)
+}
+
+// Decode decodes an image and turns it upright according to its EXIF or
+// XMP orientation.
+func Decode(data []byte) (image.Image, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", formatError(data, err)
+	}
+	return Orient(img, ReadMetadata(data).Orientation), format, nil
+}
+
+// Orient applies an EXIF orientation (1 to 8) to img, so that the result
+// displays upright without metadata.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs 90 clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs 90 counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// portableFormats are the formats consumers such as the embedding service
+// can be expected to read.
+var portableFormats = map[string]bool{"jpeg": true, "png": true, "webp": true, "gif": true}
+
+// Portable reports whether images in format can be passed as they are to
+// consumers such as the embedding service, provided they are upright.
+func Portable(format string) bool {
+	return portableFormats[format]
+}
+
+// UprightBytes returns data unchanged when it is an upright image in a
+// portable format (JPEG, PNG, WebP or GIF), and otherwise img (the decoded,
+// oriented image) re-encoded as a high quality JPEG, for consumers such as
+// the embedding service that ignore EXIF or cannot read TIFF, BMP, HEIC or
+// AVIF.
+func UprightBytes(data []byte, img image.Image, format string, orientation int) ([]byte, error) {
+	if (orientation < 2 || orientation > 8) && portableFormats[format] {
+		return data, nil
+	}
+	return PortableBytes(img)
+}
+
+// PortableBytes encodes img as a high quality JPEG.
+func PortableBytes(img image.Image) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Upright is UprightBytes for callers that have not decoded data.
+func Upright(data []byte) ([]byte, error) {
+	if ReadMetadata(data).Orientation == 1 && portableFormats[Sniff(data)] {
+		return data, nil
+	}
+	img, _, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return PortableBytes(img)
+}
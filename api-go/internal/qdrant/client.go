@@ -40,6 +40,9 @@ type SearchRequest struct {
 	WithPayload bool                   `json:"with_payload"`
 	WithVector  bool                   `json:"with_vector"`
 	Threshold   *float32               `json:"score_threshold,omitempty"`
+	// ExcludeIDs are point IDs that must not appear in the results. They are
+	// merged into the filter as a must_not has_id condition.
+	ExcludeIDs []interface{} `json:"-"`
 }
 
 type SearchResult struct {
@@ -49,6 +52,56 @@ type SearchResult struct {
 	Vector  Vector      `json:"vector,omitempty"`
 }
 
+// GroupSearchRequest is a search whose hits are grouped by the values of a
+// keyword or integer payload field. Limit is the number of groups.
+type GroupSearchRequest struct {
+	Vector      interface{}            `json:"vector"`
+	Filter      map[string]interface{} `json:"filter,omitempty"`
+	GroupBy     string                 `json:"group_by"`
+	GroupSize   int                    `json:"group_size"`
+	Limit       int                    `json:"limit"`
+	WithPayload bool                   `json:"with_payload"`
+	WithVector  bool                   `json:"with_vector"`
+	Threshold   *float32               `json:"score_threshold,omitempty"`
+	ExcludeIDs  []interface{}          `json:"-"`
+}
+
+// Group is one group of a grouped search. ID is the payload value the hits
+// share; a point with an array value can appear in several groups.
+type Group struct {
+	ID   interface{}    `json:"id"`
+	Hits []SearchResult `json:"hits"`
+}
+
+// RecommendRequest finds points close to the positive examples and away from
+// the negative ones. Examples are point IDs.
+type RecommendRequest struct {
+	Positive    []interface{}          `json:"positive"`
+	Negative    []interface{}          `json:"negative,omitempty"`
+	Strategy    string                 `json:"strategy,omitempty"` // "average_vector" or "best_score"
+	Filter      map[string]interface{} `json:"filter,omitempty"`
+	Limit       int                    `json:"limit"`
+	WithPayload bool                   `json:"with_payload"`
+	WithVector  bool                   `json:"with_vector"`
+	Threshold   *float32               `json:"score_threshold,omitempty"`
+}
+
+// ScrollRequest describes one page of a scroll over the collection.
+type ScrollRequest struct {
+	Filter     map[string]interface{}
+	Limit      int
+	Offset     interface{} // next_page_offset returned by the previous page
+	WithVector bool
+	// OrderBy sorts the scroll by an indexed payload field. Qdrant does not
+	// return a next page offset for ordered scrolls.
+	OrderBy *OrderBy
+}
+
+type OrderBy struct {
+	Key       string `json:"key"`
+	Direction string `json:"direction,omitempty"` // "asc" or "desc"
+}
+
 type CreateCollectionRequest struct {
 	Vectors VectorConfig `json:"vectors"`
 }
@@ -91,50 +144,59 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body interf
 	return c.httpClient.Do(req)
 }
 
+// payloadIndices lists the payload fields that get an index. Creating an
+// index is idempotent, so fields added here are picked up by existing
+// collections on the next start.
+var payloadIndices = []struct {
+	field    string
+	dataType string
+}{
+	{"tags", "keyword"},
+	{"album", "keyword"},
+	{"owner_user_id", "keyword"},
+	{"created_at", "datetime"},
+	{"nsfw_score", "float"},
+	{"sha256", "keyword"},
+	{"phash", "keyword"},
+	{"anomaly_score", "float"},
+	{"image_id", "keyword"},
+	{"source", "keyword"},
+	{"camera_make", "keyword"},
+	{"camera_model", "keyword"},
+	{"captured_at", "datetime"},
+	{"location", "geo"},
+}
+
 func (c *Client) EnsureCollection(ctx context.Context) error {
 	// Check if collection exists
 	resp, err := c.doRequest(ctx, "GET", "/collections/"+CollectionName, nil)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		return nil // Collection already exists
-	}
+	resp.Body.Close()
 
-	// Create collection
-	createReq := CreateCollectionRequest{
-		Vectors: VectorConfig{
-			Size:     VectorSize,
-			Distance: "Cosine",
-		},
-	}
+	if resp.StatusCode != http.StatusOK {
+		// Create collection
+		createReq := CreateCollectionRequest{
+			Vectors: VectorConfig{
+				Size:     VectorSize,
+				Distance: "Cosine",
+			},
+		}
 
-	resp, err = c.doRequest(ctx, "PUT", "/collections/"+CollectionName, createReq)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+		resp, err = c.doRequest(ctx, "PUT", "/collections/"+CollectionName, createReq)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to create collection: %s", resp.Status)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to create collection: %s", resp.Status)
+		}
 	}
 
 	// Create payload indices
-	indices := []struct {
-		field    string
-		dataType string
-	}{
-		{"tags", "keyword"},
-		{"owner_user_id", "keyword"},
-		{"created_at", "datetime"},
-		{"nsfw_score", "float"},
-		{"sha256", "keyword"},
-		{"phash", "keyword"},
-	}
-
-	for _, idx := range indices {
+	for _, idx := range payloadIndices {
 		indexReq := map[string]interface{}{
 			"field_name": idx.field,
 			"field_type": idx.dataType,
@@ -176,13 +238,73 @@ func (c *Client) UpsertPoint(ctx context.Context, point Point) error {
 	return nil
 }
 
+// excludeIDs adds a must_not has_id condition to an already translated
+// Qdrant filter.
+func excludeIDs(filter map[string]interface{}, ids []interface{}) map[string]interface{} {
+	if len(ids) == 0 {
+		return filter
+	}
+	if filter == nil {
+		filter = map[string]interface{}{}
+	}
+	mustNot, _ := filter["must_not"].([]map[string]interface{})
+	filter["must_not"] = append(mustNot, map[string]interface{}{"has_id": ids})
+	return filter
+}
+
+// decodeJSON decodes a Qdrant response keeping numbers as json.Number, so
+// that 64-bit integer point IDs survive the round trip without being rounded
+// through float64.
+func decodeJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// Range is a numeric range condition usable as a value in simple filters.
+type Range struct {
+	GT  *float64 `json:"gt,omitempty"`
+	GTE *float64 `json:"gte,omitempty"`
+	LT  *float64 `json:"lt,omitempty"`
+	LTE *float64 `json:"lte,omitempty"`
+}
+
+// DatetimeRange is a range condition on a datetime payload field, with
+// RFC 3339 bounds, usable as a value in simple filters.
+type DatetimeRange struct {
+	GT  string `json:"gt,omitempty"`
+	GTE string `json:"gte,omitempty"`
+	LT  string `json:"lt,omitempty"`
+	LTE string `json:"lte,omitempty"`
+}
+
+// MatchAny matches a keyword payload field holding any of the values,
+// usable as a value in simple filters.
+type MatchAny []string
+
+// Exists matches points where the payload field is set and not null, usable
+// as a value in simple filters.
+type Exists struct{}
+
 // buildQdrantFilter converts simple key-value filters to Qdrant's must/match format
 func buildQdrantFilter(simple map[string]interface{}) map[string]interface{} {
 	if len(simple) == 0 {
 		return nil
 	}
 	must := make([]map[string]interface{}, 0, len(simple))
+	var mustNot []map[string]interface{}
 	for k, v := range simple {
+		switch r := v.(type) {
+		case Range, DatetimeRange:
+			must = append(must, map[string]interface{}{"key": k, "range": r})
+			continue
+		case MatchAny:
+			must = append(must, map[string]interface{}{"key": k, "match": map[string]interface{}{"any": r}})
+			continue
+		case Exists:
+			mustNot = append(mustNot, map[string]interface{}{"is_empty": map[string]interface{}{"key": k}})
+			continue
+		}
 		must = append(must, map[string]interface{}{
 			"key": k,
 			"match": map[string]interface{}{
@@ -190,7 +312,14 @@ func buildQdrantFilter(simple map[string]interface{}) map[string]interface{} {
 			},
 		})
 	}
-	return map[string]interface{}{"must": must}
+	filter := map[string]interface{}{}
+	if len(must) > 0 {
+		filter["must"] = must
+	}
+	if len(mustNot) > 0 {
+		filter["must_not"] = mustNot
+	}
+	return filter
 }
 
 func (c *Client) Search(ctx context.Context, req SearchRequest) ([]SearchResult, error) {
@@ -198,6 +327,7 @@ func (c *Client) Search(ctx context.Context, req SearchRequest) ([]SearchResult,
 	if req.Filter != nil {
 		req.Filter = buildQdrantFilter(req.Filter)
 	}
+	req.Filter = excludeIDs(req.Filter, req.ExcludeIDs)
 
 	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points/search", CollectionName), req)
 	if err != nil {
@@ -213,12 +343,78 @@ func (c *Client) Search(ctx context.Context, req SearchRequest) ([]SearchResult,
 	var result struct {
 		Result []SearchResult `json:"result"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := decodeJSON(resp.Body, &result); err != nil {
 		return nil, err
 	}
 	return result.Result, nil
 }
 
+// SearchBatch runs several searches in one request. The result lists are in
+// the order of reqs.
+func (c *Client) SearchBatch(ctx context.Context, reqs []SearchRequest) ([][]SearchResult, error) {
+	searches := make([]SearchRequest, len(reqs))
+	for i, req := range reqs {
+		if req.Filter != nil {
+			req.Filter = buildQdrantFilter(req.Filter)
+		}
+		req.Filter = excludeIDs(req.Filter, req.ExcludeIDs)
+		searches[i] = req
+	}
+
+	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points/search/batch", CollectionName),
+		map[string]interface{}{"searches": searches})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("batch search failed: %s: %s", resp.Status, string(body))
+	}
+
+	var result struct {
+		Result [][]SearchResult `json:"result"`
+	}
+	if err := decodeJSON(resp.Body, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Result) != len(reqs) {
+		return nil, fmt.Errorf("batch search returned %d result lists for %d searches", len(result.Result), len(reqs))
+	}
+	return result.Result, nil
+}
+
+// SearchGroups runs a search and returns at most GroupSize hits per value of
+// the GroupBy field.
+func (c *Client) SearchGroups(ctx context.Context, req GroupSearchRequest) ([]Group, error) {
+	if req.Filter != nil {
+		req.Filter = buildQdrantFilter(req.Filter)
+	}
+	req.Filter = excludeIDs(req.Filter, req.ExcludeIDs)
+
+	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points/search/groups", CollectionName), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("group search failed: %s: %s", resp.Status, string(body))
+	}
+
+	var result struct {
+		Result struct {
+			Groups []Group `json:"groups"`
+		} `json:"result"`
+	}
+	if err := decodeJSON(resp.Body, &result); err != nil {
+		return nil, err
+	}
+	return result.Result.Groups, nil
+}
+
 func (c *Client) SearchByPoint(ctx context.Context, pointID interface{}, limit int, filter map[string]interface{}, scoreThreshold *float32) ([]SearchResult, error) {
 	// First, get the point to extract its vector
 	point, err := c.GetPoint(ctx, fmt.Sprintf("%v", pointID))
@@ -257,7 +453,32 @@ func (c *Client) SearchByPoint(ctx context.Context, pointID interface{}, limit i
 	var result struct {
 		Result []SearchResult `json:"result"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := decodeJSON(resp.Body, &result); err != nil {
+		return nil, err
+	}
+	return result.Result, nil
+}
+
+// Recommend runs Qdrant's recommendation API. The examples themselves are
+// never returned.
+func (c *Client) Recommend(ctx context.Context, req RecommendRequest) ([]SearchResult, error) {
+	req.Filter = buildQdrantFilter(req.Filter)
+
+	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points/recommend", CollectionName), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("recommend failed: %s: %s", resp.Status, string(body))
+	}
+
+	var result struct {
+		Result []SearchResult `json:"result"`
+	}
+	if err := decodeJSON(resp.Body, &result); err != nil {
 		return nil, err
 	}
 	return result.Result, nil
@@ -298,7 +519,7 @@ func (c *Client) GetPoint(ctx context.Context, id string) (*Point, error) {
 			Points []Point `json:"points"`
 		} `json:"result"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := decodeJSON(resp.Body, &result); err != nil {
 		return nil, err
 	}
 
@@ -317,48 +538,147 @@ func (c *Client) ScrollPoints(ctx context.Context, filter map[string]interface{}
 }
 
 func (c *Client) ScrollPointsWithVector(ctx context.Context, filter map[string]interface{}, limit int, withVector bool) ([]Point, error) {
-	// Translate simple equality filter map into Qdrant filter structure
-	var qFilter map[string]interface{}
-	if len(filter) > 0 {
-		must := make([]map[string]interface{}, 0, len(filter))
-		for k, v := range filter {
-			must = append(must, map[string]interface{}{
-				"key": k,
-				"match": map[string]interface{}{
-					"value": v,
-				},
-			})
+	points, _, err := c.ScrollPage(ctx, ScrollRequest{Filter: filter, Limit: limit, WithVector: withVector})
+	return points, err
+}
+
+// ScrollPage returns one page of points together with the offset of the next
+// page, which is nil once the collection is exhausted.
+func (c *Client) ScrollPage(ctx context.Context, sr ScrollRequest) ([]Point, interface{}, error) {
+	req := map[string]interface{}{
+		"filter":       buildQdrantFilter(sr.Filter),
+		"limit":        sr.Limit,
+		"with_payload": true,
+		"with_vector":  sr.WithVector,
+	}
+	if sr.Offset != nil {
+		req["offset"] = sr.Offset
+	}
+	if sr.OrderBy != nil {
+		req["order_by"] = sr.OrderBy
+	}
+
+	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points/scroll", CollectionName), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("scroll failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Result struct {
+			Points         []Point     `json:"points"`
+			NextPageOffset interface{} `json:"next_page_offset"`
+		} `json:"result"`
+	}
+	if err := decodeJSON(resp.Body, &result); err != nil {
+		return nil, nil, err
+	}
+
+	return result.Result.Points, result.Result.NextPageOffset, nil
+}
+
+// ScrollAll pages through every point matching filter.
+func (c *Client) ScrollAll(ctx context.Context, filter map[string]interface{}, withVector bool) ([]Point, error) {
+	var all []Point
+	var offset interface{}
+	for {
+		points, next, err := c.ScrollPage(ctx, ScrollRequest{Filter: filter, Limit: 256, Offset: offset, WithVector: withVector})
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, points...)
+		if next == nil || len(points) == 0 {
+			return all, nil
 		}
-		qFilter = map[string]interface{}{"must": must}
+		offset = next
 	}
+}
 
+// RetrievePoints fetches points by ID. IDs that do not exist are skipped.
+func (c *Client) RetrievePoints(ctx context.Context, ids []interface{}, withVector bool) ([]Point, error) {
 	req := map[string]interface{}{
-		"filter":       qFilter,
-		"limit":        limit,
+		"ids":          ids,
 		"with_payload": true,
 		"with_vector":  withVector,
 	}
-
-	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points/scroll", CollectionName), req)
+	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points", CollectionName), req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("scroll failed: %s", resp.Status)
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("retrieve failed: %s: %s", resp.Status, string(body))
+	}
+
+	var result struct {
+		Result []Point `json:"result"`
+	}
+	if err := decodeJSON(resp.Body, &result); err != nil {
+		return nil, err
+	}
+	return result.Result, nil
+}
+
+// Count returns the exact number of points matching filter.
+func (c *Client) Count(ctx context.Context, filter map[string]interface{}) (int, error) {
+	req := map[string]interface{}{
+		"filter": buildQdrantFilter(filter),
+		"exact":  true,
+	}
+	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points/count", CollectionName), req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("count failed: %s", resp.Status)
 	}
 
 	var result struct {
 		Result struct {
-			Points []Point `json:"points"`
+			Count int `json:"count"`
 		} `json:"result"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+		return 0, err
+	}
+	return result.Result.Count, nil
+}
+
+// SetPayloads merges a separate payload into each point in a single batch
+// request. Keys not mentioned are left untouched.
+func (c *Client) SetPayloads(ctx context.Context, payloads map[interface{}]Payload) error {
+	if len(payloads) == 0 {
+		return nil
 	}
+	ops := make([]map[string]interface{}, 0, len(payloads))
+	for id, payload := range payloads {
+		ops = append(ops, map[string]interface{}{
+			"set_payload": map[string]interface{}{
+				"payload": payload,
+				"points":  []interface{}{id},
+			},
+		})
+	}
+	req := map[string]interface{}{"operations": ops}
+	resp, err := c.doRequest(ctx, "POST", fmt.Sprintf("/collections/%s/points/batch", CollectionName), req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-	return result.Result.Points, nil
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to set payload: %s: %s", resp.Status, string(body))
+	}
+	return nil
 }
 
 func (c *Client) DeletePoint(ctx context.Context, id interface{}) error {
@@ -0,0 +1,652 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidKey    = errors.New("invalid object key")
+	errBadSignature  = errors.New("invalid or expired signature")
+	errEntityTooLong = errors.New("file exceeds the allowed size")
+)
+
+// LocalStore keeps objects as files under a directory, so the API can run
+// without S3. Its presigned URLs point back at the API: ServeHTTP, mounted
+// at baseURL, checks their HMAC signature and serves or stores the file.
+//
+// The directory holds objects/<key>, meta/<key> with the object's content
+// type, and uploads/<upload id>/ with the parts of multipart uploads.
+type LocalStore struct {
+	dir     string
+	baseURL string
+	secret  []byte
+}
+
+func NewLocalStore(dir, baseURL string, secret []byte) (*LocalStore, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("local storage needs a signing secret")
+	}
+	for _, sub := range []string{"objects", "meta", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &LocalStore{
+		dir:     dir,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		secret:  secret,
+	}, nil
+}
+
+// Bucket returns "local"; there is a single store.
+func (s *LocalStore) Bucket() string {
+	return "local"
+}
+
+func (s *LocalStore) path(sub, key string) (string, error) {
+	if !filepath.IsLocal(key) || strings.HasSuffix(key, "/") || strings.Contains(key, `\`) {
+		return "", fmt.Errorf("%w: %q", errInvalidKey, key)
+	}
+	return filepath.Join(s.dir, sub, filepath.FromSlash(key)), nil
+}
+
+// mac signs fields joined by newlines.
+func (s *LocalStore) mac(fields ...string) string {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// signedURL returns a URL allowing method on key, with params, until expiry
+// has passed.
+func (s *LocalStore) signedURL(method, key string, expiry time.Duration, params url.Values) string {
+	if params == nil {
+		params = url.Values{}
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	sig := s.mac(method, key, expires, params.Encode())
+	params.Set("X-Expires", expires)
+	params.Set("X-Signature", sig)
+	return s.baseURL + (&url.URL{Path: "/" + key}).EscapedPath() + "?" + params.Encode()
+}
+
+// verify checks a URL made by signedURL.
+func (s *LocalStore) verify(method, key string, query url.Values) error {
+	params := url.Values{}
+	for k, v := range query {
+		params[k] = v
+	}
+	expires, sig := params.Get("X-Expires"), params.Get("X-Signature")
+	params.Del("X-Expires")
+	params.Del("X-Signature")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return errBadSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.mac(method, key, expires, params.Encode()))) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// postPolicy is what a presigned POST allows, signed in its "policy" field.
+type postPolicy struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	MaxBytes    int64  `json:"max_bytes"`
+	Expires     int64  `json:"expires"`
+}
+
+// GetPresignedPost returns a POST policy that only accepts an object at key
+// with the given content type and, when maxBytes is positive, at most
+// maxBytes long.
+func (s *LocalStore) GetPresignedPost(ctx context.Context, key, contentType string, maxBytes int64, expiry time.Duration) (PresignedPost, error) {
+	if _, err := s.path("objects", key); err != nil {
+		return PresignedPost{}, err
+	}
+	raw, err := json.Marshal(postPolicy{
+		Key:         key,
+		ContentType: contentType,
+		MaxBytes:    maxBytes,
+		Expires:     time.Now().Add(expiry).Unix(),
+	})
+	if err != nil {
+		return PresignedPost{}, err
+	}
+	policy := base64.StdEncoding.EncodeToString(raw)
+	return PresignedPost{
+		URL: s.baseURL + "/",
+		Fields: map[string]string{
+			"key":          key,
+			"Content-Type": contentType,
+			"policy":       policy,
+			"x-signature":  s.mac(http.MethodPost, policy),
+		},
+	}, nil
+}
+
+func (s *LocalStore) GetPresignedUploadURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if _, err := s.path("objects", key); err != nil {
+		return "", err
+	}
+	return s.signedURL(http.MethodPut, key, expiry, nil), nil
+}
+
+func (s *LocalStore) GetPresignedDownloadURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if _, err := s.path("objects", key); err != nil {
+		return "", err
+	}
+	return s.signedURL(http.MethodGet, key, expiry, nil), nil
+}
+
+func (s *LocalStore) DownloadFile(ctx context.Context, key string) ([]byte, error) {
+	r, _, err := s.OpenReader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// OpenReader streams an object, returning ErrNotFound when it does not
+// exist. The caller closes the reader.
+func (s *LocalStore) OpenReader(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := s.path("objects", key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, s.notFound(key, err)
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, s.notFound(key, err)
+	}
+	return f, s.info(key, fi), nil
+}
+
+func (s *LocalStore) UploadFile(ctx context.Context, key string, data []byte, contentType string) error {
+	return s.writeObject(key, contentType, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// DeleteFile removes an object; removing a missing object is not an error.
+func (s *LocalStore) DeleteFile(ctx context.Context, key string) error {
+	for _, sub := range []string{"objects", "meta"} {
+		p, err := s.path(sub, key)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) FileExists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Stat(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Stat returns the size and metadata of an object, or ErrNotFound.
+func (s *LocalStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := s.path("objects", key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err == nil && fi.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return ObjectInfo{}, s.notFound(key, err)
+	}
+	return s.info(key, fi), nil
+}
+
+func (s *LocalStore) notFound(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return err
+}
+
+// info describes an object file. The ETag changes whenever the file is
+// rewritten.
+func (s *LocalStore) info(key string, fi fs.FileInfo) ObjectInfo {
+	contentType := "application/octet-stream"
+	if p, err := s.path("meta", key); err == nil {
+		if ct, err := os.ReadFile(p); err == nil && len(ct) > 0 {
+			contentType = string(ct)
+		}
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  contentType,
+		ETag:         fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+		LastModified: fi.ModTime(),
+	}
+}
+
+// writeObject replaces key with what fill writes, and records its content
+// type. Readers never see a partly written object.
+func (s *LocalStore) writeObject(key, contentType string, fill func(io.Writer) error) error {
+	p, err := s.path("objects", key)
+	if err != nil {
+		return err
+	}
+	mp, err := s.path("meta", key)
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(p, fill); err != nil {
+		return err
+	}
+	return writeAtomic(mp, func(w io.Writer) error {
+		_, err := io.WriteString(w, contentType)
+		return err
+	})
+}
+
+// writeAtomic writes a temporary file next to path and renames it over path
+// once fill succeeds.
+func writeAtomic(path string, fill func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = fill(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// copyLimited copies r to w, failing once more than max bytes were read.
+// max <= 0 means no limit.
+func copyLimited(w io.Writer, r io.Reader, max int64) error {
+	if max <= 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	n, err := io.Copy(w, io.LimitReader(r, max+1))
+	if err == nil && n > max {
+		err = errEntityTooLong
+	}
+	return err
+}
+
+// uploadInfo is the record of a multipart upload, kept in its directory.
+type uploadInfo struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	Initiated   time.Time `json:"initiated"`
+}
+
+// uploadDir returns the directory of a multipart upload and its record.
+// Upload IDs are checked before use since they arrive in URLs.
+func (s *LocalStore) uploadDir(key, uploadID string) (string, uploadInfo, error) {
+	var info uploadInfo
+	if id, err := hex.DecodeString(uploadID); err != nil || len(id) != 16 {
+		return "", info, fmt.Errorf("%w: upload %s", ErrNotFound, uploadID)
+	}
+	dir := filepath.Join(s.dir, "uploads", uploadID)
+	raw, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		return "", info, s.notFound("upload "+uploadID, err)
+	}
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return "", info, err
+	}
+	if key != "" && info.Key != key {
+		return "", info, fmt.Errorf("%w: upload %s of %s", ErrNotFound, uploadID, key)
+	}
+	return dir, info, nil
+}
+
+// InitiateMultipart starts a multipart upload of key and returns its upload
+// ID. The object gets contentType once completed.
+func (s *LocalStore) InitiateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	if _, err := s.path("objects", key); err != nil {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+	raw, err := json.Marshal(uploadInfo{Key: key, ContentType: contentType, Initiated: time.Now().UTC()})
+	if err != nil {
+		return "", err
+	}
+	err = writeAtomic(filepath.Join(s.dir, "uploads", uploadID, "upload.json"), func(w io.Writer) error {
+		_, err := w.Write(raw)
+		return err
+	})
+	return uploadID, err
+}
+
+// GetPresignedPartURL returns a URL to PUT one part of a multipart upload.
+// Parts are numbered from 1.
+func (s *LocalStore) GetPresignedPartURL(ctx context.Context, key, uploadID string, partNumber int, expiry time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("partNumber", strconv.Itoa(partNumber))
+	params.Set("uploadId", uploadID)
+	return s.signedURL(http.MethodPut, key, expiry, params), nil
+}
+
+// writePart stores one part of a multipart upload.
+func (s *LocalStore) writePart(key, uploadID string, partNumber int, r io.Reader) (Part, error) {
+	if partNumber < 1 || partNumber > 10000 {
+		return Part{}, fmt.Errorf("%w: part number %d", errInvalidKey, partNumber)
+	}
+	dir, _, err := s.uploadDir(key, uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	p := filepath.Join(dir, strconv.Itoa(partNumber))
+	if err := writeAtomic(p, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}); err != nil {
+		return Part{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return Part{}, err
+	}
+	return partInfo(partNumber, fi), nil
+}
+
+func partInfo(partNumber int, fi fs.FileInfo) Part {
+	return Part{
+		PartNumber: partNumber,
+		ETag:       fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+		Size:       fi.Size(),
+	}
+}
+
+// ListParts returns the parts uploaded so far, by part number.
+func (s *LocalStore) ListParts(ctx context.Context, key, uploadID string) ([]Part, error) {
+	dir, _, err := s.uploadDir(key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var parts []Part
+	for _, e := range entries {
+		n, err := strconv.Atoi(e.Name())
+		if err != nil || e.IsDir() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, partInfo(n, fi))
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+// CompleteMultipart assembles the parts, in part number order, into the
+// object.
+func (s *LocalStore) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	dir, info, err := s.uploadDir(key, uploadID)
+	if err != nil {
+		return err
+	}
+	sorted := append([]Part(nil), parts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PartNumber < sorted[j].PartNumber })
+	for _, p := range sorted {
+		fi, err := os.Stat(filepath.Join(dir, strconv.Itoa(p.PartNumber)))
+		if err != nil {
+			return s.notFound(fmt.Sprintf("part %d of upload %s", p.PartNumber, uploadID), err)
+		}
+		if p.ETag != "" && partInfo(p.PartNumber, fi).ETag != p.ETag {
+			return fmt.Errorf("part %d of upload %s changed", p.PartNumber, uploadID)
+		}
+	}
+	err = s.writeObject(key, info.ContentType, func(w io.Writer) error {
+		for _, p := range sorted {
+			f, err := os.Open(filepath.Join(dir, strconv.Itoa(p.PartNumber)))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// AbortMultipart discards a multipart upload and its parts.
+func (s *LocalStore) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	dir, _, err := s.uploadDir(key, uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListIncompleteUploads returns the multipart uploads under prefix that
+// were started before olderThan.
+func (s *LocalStore) ListIncompleteUploads(ctx context.Context, prefix string, olderThan time.Time) ([]IncompleteUpload, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "uploads"))
+	if err != nil {
+		return nil, err
+	}
+	var uploads []IncompleteUpload
+	for _, e := range entries {
+		_, info, err := s.uploadDir("", e.Name())
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(info.Key, prefix) && info.Initiated.Before(olderThan) {
+			uploads = append(uploads, IncompleteUpload{Key: info.Key, UploadID: e.Name(), Initiated: info.Initiated})
+		}
+	}
+	return uploads, nil
+}
+
+// ServeHTTP answers the presigned URLs: GET and HEAD download an object,
+// PUT uploads an object or a part, and POST to the root is a form upload
+// under a policy from GetPresignedPost. Mount it with the path of baseURL
+// stripped.
+func (s *LocalStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	var err error
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		err = s.serveObject(w, r, key)
+	case http.MethodPut:
+		err = s.servePut(w, r, key)
+	case http.MethodPost:
+		err = s.servePost(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, errBadSignature):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidKey), errors.Is(err, errEntityTooLong):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		// Filesystem errors name paths on the server
+		slog.Error("Local storage request failed", "error", err, "method", r.Method, "key", key)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// serveObject sends an object; http.ServeContent handles Range and the
+// conditional headers.
+func (s *LocalStore) serveObject(w http.ResponseWriter, r *http.Request, key string) error {
+	if err := s.verify(http.MethodGet, key, r.URL.Query()); err != nil {
+		return err
+	}
+	f, info, err := s.OpenReader(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("ETag", strconv.Quote(info.ETag))
+	http.ServeContent(w, r, "", info.LastModified, f.(io.ReadSeeker))
+	return nil
+}
+
+func (s *LocalStore) servePut(w http.ResponseWriter, r *http.Request, key string) error {
+	query := r.URL.Query()
+	if err := s.verify(http.MethodPut, key, query); err != nil {
+		return err
+	}
+	if uploadID := query.Get("uploadId"); uploadID != "" {
+		n, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil {
+			return fmt.Errorf("%w: part number %q", errInvalidKey, query.Get("partNumber"))
+		}
+		part, err := s.writePart(key, uploadID, n, r.Body)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("ETag", strconv.Quote(part.ETag))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	err := s.writeObject(key, contentType, func(dst io.Writer) error {
+		_, err := io.Copy(dst, r.Body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// servePost stores a form upload. As with S3, the policy fields come first
+// and the file is the last field, so it is streamed to disk.
+func (s *LocalStore) servePost(w http.ResponseWriter, r *http.Request) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidKey, err)
+	}
+	fields := map[string]string{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return fmt.Errorf("%w: no file in form", errInvalidKey)
+		}
+		if err != nil {
+			return err
+		}
+		if part.FormName() != "file" {
+			v, err := io.ReadAll(io.LimitReader(part, 64<<10))
+			if err != nil {
+				return err
+			}
+			fields[part.FormName()] = string(v)
+			continue
+		}
+
+		policy, err := s.checkPolicy(fields)
+		if err != nil {
+			return err
+		}
+		err = s.writeObject(policy.Key, policy.ContentType, func(dst io.Writer) error {
+			return copyLimited(dst, part, policy.MaxBytes)
+		})
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// checkPolicy verifies the signed policy of a form upload against the
+// form's fields.
+func (s *LocalStore) checkPolicy(fields map[string]string) (postPolicy, error) {
+	var policy postPolicy
+	encoded := fields["policy"]
+	if !hmac.Equal([]byte(fields["x-signature"]), []byte(s.mac(http.MethodPost, encoded))) {
+		return policy, errBadSignature
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return policy, errBadSignature
+	}
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		return policy, errBadSignature
+	}
+	if time.Now().Unix() > policy.Expires || fields["key"] != policy.Key || fields["Content-Type"] != policy.ContentType {
+		return policy, errBadSignature
+	}
+	return policy, nil
+}
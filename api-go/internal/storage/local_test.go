@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocalStore(t *testing.T) (*LocalStore, http.Handler) {
+	t.Helper()
+	s, err := NewLocalStore(t.TempDir(), "/api/storage", []byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, http.StripPrefix("/api/storage", s)
+}
+
+func serve(h http.Handler, method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// postForm sends a form upload with fields and then file, as browsers do.
+func postForm(h http.Handler, post PresignedPost, fields map[string]string, file []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range post.Fields {
+		if override, ok := fields[k]; ok {
+			v = override
+		}
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("file", "upload")
+	fw.Write(file)
+	mw.Close()
+	return serve(h, http.MethodPost, post.URL, &body, http.Header{"Content-Type": {mw.FormDataContentType()}})
+}
+
+func TestLocalStoreSignedDownload(t *testing.T) {
+	ctx := context.Background()
+	s, h := newTestLocalStore(t)
+	if err := s.UploadFile(ctx, "images/u/a", []byte("0123456789"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.GetPresignedDownloadURL(ctx, "images/u/a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(h, http.MethodGet, u, nil, http.Header{"Range": {"bytes=2-4"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Fatalf("range: got %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("content type %q", ct)
+	}
+	w = serve(h, http.MethodGet, u, nil, http.Header{"If-None-Match": {w.Header().Get("ETag")}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %d", w.Code)
+	}
+
+	parsed, _ := url.Parse(u)
+	q := parsed.Query()
+	forged := func(mutate func(url.Values)) string {
+		v := url.Values{}
+		for k, vs := range q {
+			v[k] = append([]string(nil), vs...)
+		}
+		mutate(v)
+		return parsed.Path + "?" + v.Encode()
+	}
+	for name, target := range map[string]string{
+		"bad signature":  forged(func(v url.Values) { v.Set("X-Signature", strings.Repeat("0", 64)) }),
+		"no signature":   forged(func(v url.Values) { v.Del("X-Signature") }),
+		"later expiry":   forged(func(v url.Values) { v.Set("X-Expires", "99999999999") }),
+		"other key":      strings.Replace(forged(func(url.Values) {}), "images/u/a", "images/u/b", 1),
+		"extra param":    forged(func(v url.Values) { v.Set("partNumber", "1") }),
+		"signed for PUT": mustSigned(t, s, http.MethodPut, "images/u/a", time.Minute),
+		"expired":        mustSigned(t, s, http.MethodGet, "images/u/a", -time.Minute),
+	} {
+		if w := serve(h, http.MethodGet, target, nil, nil); w.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d, want 403", name, w.Code)
+		}
+	}
+}
+
+func mustSigned(t *testing.T, s *LocalStore, method, key string, expiry time.Duration) string {
+	t.Helper()
+	u := s.signedURL(method, key, expiry, nil)
+	if !strings.HasPrefix(u, "/api/storage/") {
+		t.Fatalf("unexpected URL %s", u)
+	}
+	return u
+}
+
+func TestLocalStoreRejectsKeysOutsideTheStore(t *testing.T) {
+	ctx := context.Background()
+	s, h := newTestLocalStore(t)
+	secret := filepath.Join(filepath.Dir(s.dir), "secret")
+	os.WriteFile(secret, []byte("x"), 0o600)
+
+	for _, key := range []string{"../secret", "images/../../secret", "/etc/passwd", "", "images/u/", `images\..\x`} {
+		if _, err := s.Stat(ctx, key); !errors.Is(err, errInvalidKey) {
+			t.Errorf("Stat(%q): got %v, want errInvalidKey", key, err)
+		}
+		if err := s.UploadFile(ctx, key, []byte("x"), "text/plain"); !errors.Is(err, errInvalidKey) {
+			t.Errorf("UploadFile(%q): got %v, want errInvalidKey", key, err)
+		}
+		if _, err := s.GetPresignedDownloadURL(ctx, key, time.Minute); !errors.Is(err, errInvalidKey) {
+			t.Errorf("GetPresignedDownloadURL(%q): got %v, want errInvalidKey", key, err)
+		}
+	}
+
+	// A signature over a traversing key is still refused by the path check
+	u := s.signedURL(http.MethodGet, "../secret", time.Minute, nil)
+	if w := serve(h, http.MethodGet, u, nil, nil); w.Code == http.StatusOK {
+		t.Errorf("traversal was served: %q", w.Body.String())
+	}
+
+	for _, id := range []string{"../../objects", "zz", strings.Repeat("a", 31)} {
+		if _, _, err := s.uploadDir("", id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("uploadDir(%q): got %v, want ErrNotFound", id, err)
+		}
+	}
+}
+
+func TestLocalStorePostPolicy(t *testing.T) {
+	ctx := context.Background()
+	s, h := newTestLocalStore(t)
+	post, err := s.GetPresignedPost(ctx, "images/u/a", "image/png", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := postForm(h, post, nil, []byte("0123456789a")); w.Code != http.StatusBadRequest {
+		t.Errorf("oversize body: got %d, want 400", w.Code)
+	}
+	if ok, _ := s.FileExists(ctx, "images/u/a"); ok {
+		t.Error("oversize body was stored")
+	}
+	for name, fields := range map[string]map[string]string{
+		"other key":          {"key": "images/v/a"},
+		"other content type": {"Content-Type": "text/html"},
+		"forged signature":   {"x-signature": strings.Repeat("0", 64)},
+		"tampered policy":    {"policy": post.Fields["policy"] + "AA"},
+	} {
+		if w := postForm(h, post, fields, []byte("x")); w.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d, want 403", name, w.Code)
+		}
+	}
+
+	if w := postForm(h, post, nil, []byte("0123456789")); w.Code != http.StatusNoContent {
+		t.Fatalf("upload: got %d %s", w.Code, w.Body.String())
+	}
+	info, err := s.Stat(ctx, "images/u/a")
+	if err != nil || info.Size != 10 || info.ContentType != "image/png" {
+		t.Errorf("stored %+v, %v", info, err)
+	}
+
+	expired, _ := s.GetPresignedPost(ctx, "images/u/b", "image/png", 10, -time.Minute)
+	if w := postForm(h, expired, nil, []byte("x")); w.Code != http.StatusForbidden {
+		t.Errorf("expired policy: got %d, want 403", w.Code)
+	}
+}
+
+func TestLocalStoreMultipartOutOfOrder(t *testing.T) {
+	ctx := context.Background()
+	s, h := newTestLocalStore(t)
+	id, err := s.InitiateMultipart(ctx, "images/u/m", "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parts arrive out of order, and part 2 is sent twice
+	for _, p := range []struct {
+		n    int
+		body string
+	}{{3, "!"}, {2, "wrong"}, {1, "hello "}, {2, "world"}} {
+		u, _ := s.GetPresignedPartURL(ctx, "images/u/m", id, p.n, time.Minute)
+		if w := serve(h, http.MethodPut, u, strings.NewReader(p.body), nil); w.Code != http.StatusOK {
+			t.Fatalf("part %d: got %d %s", p.n, w.Code, w.Body.String())
+		}
+	}
+
+	// A part URL only works for its own part
+	u, _ := s.GetPresignedPartURL(ctx, "images/u/m", id, 1, time.Minute)
+	if w := serve(h, http.MethodPut, strings.Replace(u, "partNumber=1", "partNumber=4", 1), strings.NewReader("x"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("renumbered part: got %d, want 403", w.Code)
+	}
+
+	parts, err := s.ListParts(ctx, "images/u/m", id)
+	if err != nil || len(parts) != 3 {
+		t.Fatalf("ListParts: %v, %v", parts, err)
+	}
+	if _, err := s.ListParts(ctx, "images/u/other", id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ListParts of another key: got %v", err)
+	}
+	reversed := []Part{parts[2], parts[1], parts[0]}
+	if err := s.CompleteMultipart(ctx, "images/u/m", id, reversed); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.DownloadFile(ctx, "images/u/m")
+	if err != nil || string(data) != "hello world!" {
+		t.Errorf("assembled %q, %v", data, err)
+	}
+	if uploads, _ := s.ListIncompleteUploads(ctx, "images/", time.Now().Add(time.Hour)); len(uploads) != 0 {
+		t.Errorf("upload still listed after completion: %v", uploads)
+	}
+}
+
+func TestLocalStoreMultipartRejectsChangedParts(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestLocalStore(t)
+	id, _ := s.InitiateMultipart(ctx, "images/u/m", "image/jpeg")
+	if _, err := s.writePart("images/u/m", id, 1, strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompleteMultipart(ctx, "images/u/m", id, []Part{{PartNumber: 1, ETag: "stale"}}); err == nil {
+		t.Error("completed with a stale ETag")
+	}
+	if err := s.CompleteMultipart(ctx, "images/u/m", id, []Part{{PartNumber: 2}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing part: got %v, want ErrNotFound", err)
+	}
+	if err := s.AbortMultipart(ctx, "images/u/m", id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ListParts(ctx, "images/u/m", id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("aborted upload still there: %v", err)
+	}
+}
+
+func TestLocalStoreHidesInternalErrors(t *testing.T) {
+	ctx := context.Background()
+	s, h := newTestLocalStore(t)
+	// A directory where the object file belongs makes the write fail
+	if err := os.MkdirAll(filepath.Join(s.dir, "objects", "images", "u", "a", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := s.GetPresignedUploadURL(ctx, "images/u/a", time.Minute)
+	w := serve(h, http.MethodPut, u, strings.NewReader("x"), nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want 500", w.Code)
+	}
+	if strings.Contains(w.Body.String(), s.dir) {
+		t.Errorf("response leaks the storage path: %s", w.Body.String())
+	}
+}
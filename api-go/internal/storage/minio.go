@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
@@ -14,6 +15,18 @@ import (
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+// ErrNotFound is returned when an object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
 type MinioClient struct {
 	client *minio.Client
 	bucket string
@@ -58,6 +71,47 @@ func NewMinioClient(endpoint, accessKey, secretKey, bucket, region string) (*Min
 	}, nil
 }
 
+// Bucket returns the name of the bucket objects are stored in.
+func (m *MinioClient) Bucket() string {
+	return m.bucket
+}
+
+// PresignedPost is a browser form upload: Fields, then the file as the last
+// field "file", sent as multipart/form-data to URL.
+type PresignedPost struct {
+	URL    string
+	Fields map[string]string
+}
+
+// GetPresignedPost returns a POST policy that only accepts an object at key
+// with the given content type and, when maxBytes is positive, at most
+// maxBytes long.
+func (m *MinioClient) GetPresignedPost(ctx context.Context, key, contentType string, maxBytes int64, expiry time.Duration) (PresignedPost, error) {
+	policy := minio.NewPostPolicy()
+	if err := policy.SetBucket(m.bucket); err != nil {
+		return PresignedPost{}, err
+	}
+	if err := policy.SetKey(key); err != nil {
+		return PresignedPost{}, err
+	}
+	if err := policy.SetExpires(time.Now().UTC().Add(expiry)); err != nil {
+		return PresignedPost{}, err
+	}
+	if err := policy.SetContentType(contentType); err != nil {
+		return PresignedPost{}, err
+	}
+	if maxBytes > 0 {
+		if err := policy.SetContentLengthRange(1, maxBytes); err != nil {
+			return PresignedPost{}, err
+		}
+	}
+	u, fields, err := m.client.PresignedPostPolicy(ctx, policy)
+	if err != nil {
+		return PresignedPost{}, err
+	}
+	return PresignedPost{URL: u.String(), Fields: fields}, nil
+}
+
 func (m *MinioClient) GetPresignedUploadURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
 	url, err := m.client.PresignedPutObject(ctx, m.bucket, key, expiry)
 	if err != nil {
@@ -74,21 +128,38 @@ func (m *MinioClient) GetPresignedDownloadURL(ctx context.Context, key string, e
 	return url.String(), nil
 }
 
+// DownloadFile reads a whole object into one buffer of its size. Prefer
+// OpenReader for objects that can be processed as a stream.
 func (m *MinioClient) DownloadFile(ctx context.Context, key string) ([]byte, error) {
-	object, err := m.client.GetObject(ctx, m.bucket, key, minio.GetObjectOptions{})
+	object, info, err := m.OpenReader(ctx, key)
 	if err != nil {
 		return nil, err
 	}
 	defer object.Close()
 
-	data, err := io.ReadAll(object)
-	if err != nil {
+	data := make([]byte, info.Size)
+	if _, err := io.ReadFull(object, data); err != nil {
 		return nil, err
 	}
 
 	return data, nil
 }
 
+// OpenReader streams an object, returning ErrNotFound when it does not
+// exist. The caller closes the reader.
+func (m *MinioClient) OpenReader(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	object, err := m.client.GetObject(ctx, m.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, statError(key, err)
+	}
+	return object, objectInfo(info), nil
+}
+
 func (m *MinioClient) UploadFile(ctx context.Context, key string, data []byte, contentType string) error {
 	_, err := m.client.PutObject(ctx, m.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
 		ContentType: contentType,
@@ -100,6 +171,33 @@ func (m *MinioClient) DeleteFile(ctx context.Context, key string) error {
 	return m.client.RemoveObject(ctx, m.bucket, key, minio.RemoveObjectOptions{})
 }
 
+// Stat returns the size and metadata of an object without downloading it,
+// or ErrNotFound.
+func (m *MinioClient) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := m.client.StatObject(ctx, m.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, statError(key, err)
+	}
+	return objectInfo(info), nil
+}
+
+func statError(key string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return err
+}
+
+func objectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}
+}
+
 func (m *MinioClient) FileExists(ctx context.Context, key string) (bool, error) {
 	_, err := m.client.StatObject(ctx, m.bucket, key, minio.StatObjectOptions{})
 	if err != nil {
@@ -118,9 +216,16 @@ func ComputeSHA256(data []byte) string {
 }
 
 func GenerateImageKey(userID, imageID string) string {
-	return fmt.Sprintf("images/%s/%s", userID, imageID)
+	return ImageKeyPrefix(userID) + imageID
+}
+
+// ImageKeyPrefix is the prefix of every original image key of a user.
+func ImageKeyPrefix(userID string) string {
+	return fmt.Sprintf("images/%s/", userID)
 }
 
-func GenerateThumbnailKey(userID, imageID string) string {
-	return fmt.Sprintf("thumbnails/%s/%s.webp", userID, imageID)
+// GenerateThumbnailKey returns the key of the size px thumbnail of an image,
+// with ext matching the thumbnail's encoding.
+func GenerateThumbnailKey(userID, imageID string, size int, ext string) string {
+	return fmt.Sprintf("thumbnails/%s/%s/%d.%s", userID, imageID, size, ext)
 }
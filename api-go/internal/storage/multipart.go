@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Part is an uploaded part of a multipart upload.
+type Part struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+// IncompleteUpload is a multipart upload that was neither completed nor
+// aborted.
+type IncompleteUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+func (m *MinioClient) core() minio.Core {
+	return minio.Core{Client: m.client}
+}
+
+// InitiateMultipart starts a multipart upload of key and returns its upload
+// ID. The object gets contentType once completed.
+func (m *MinioClient) InitiateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	return m.core().NewMultipartUpload(ctx, m.bucket, key, minio.PutObjectOptions{ContentType: contentType})
+}
+
+// GetPresignedPartURL returns a URL to PUT one part of a multipart upload.
+// Parts are numbered from 1.
+func (m *MinioClient) GetPresignedPartURL(ctx context.Context, key, uploadID string, partNumber int, expiry time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("partNumber", strconv.Itoa(partNumber))
+	params.Set("uploadId", uploadID)
+	u, err := m.client.Presign(ctx, http.MethodPut, m.bucket, key, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// ListParts returns the parts uploaded so far, by part number.
+func (m *MinioClient) ListParts(ctx context.Context, key, uploadID string) ([]Part, error) {
+	var parts []Part
+	marker := 0
+	for {
+		res, err := m.core().ListObjectParts(ctx, m.bucket, key, uploadID, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range res.ObjectParts {
+			parts = append(parts, Part{PartNumber: p.PartNumber, ETag: p.ETag, Size: p.Size})
+		}
+		if !res.IsTruncated {
+			return parts, nil
+		}
+		marker = res.NextPartNumberMarker
+	}
+}
+
+// CompleteMultipart assembles the parts, in part number order, into the
+// object.
+func (m *MinioClient) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	complete := make([]minio.CompletePart, len(parts))
+	for i, p := range parts {
+		complete[i] = minio.CompletePart{PartNumber: p.PartNumber, ETag: p.ETag}
+	}
+	_, err := m.core().CompleteMultipartUpload(ctx, m.bucket, key, uploadID, complete, minio.PutObjectOptions{})
+	return err
+}
+
+// AbortMultipart discards a multipart upload and its parts.
+func (m *MinioClient) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	return m.core().AbortMultipartUpload(ctx, m.bucket, key, uploadID)
+}
+
+// ListIncompleteUploads returns the multipart uploads under prefix that
+// were started before olderThan.
+func (m *MinioClient) ListIncompleteUploads(ctx context.Context, prefix string, olderThan time.Time) ([]IncompleteUpload, error) {
+	var uploads []IncompleteUpload
+	for u := range m.client.ListIncompleteUploads(ctx, m.bucket, prefix, true) {
+		if u.Err != nil {
+			return uploads, u.Err
+		}
+		if u.Initiated.Before(olderThan) {
+			uploads = append(uploads, IncompleteUpload{Key: u.Key, UploadID: u.UploadID, Initiated: u.Initiated})
+		}
+	}
+	return uploads, nil
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Store keeps original images and thumbnails. MinioClient stores them in an
+// S3-compatible bucket; LocalStore keeps them on disk and has the API serve
+// its signed URLs.
+type Store interface {
+	// Bucket names where objects are kept; clients send it back on ingest.
+	Bucket() string
+
+	GetPresignedPost(ctx context.Context, key, contentType string, maxBytes int64, expiry time.Duration) (PresignedPost, error)
+	GetPresignedUploadURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+	GetPresignedDownloadURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+
+	DownloadFile(ctx context.Context, key string) ([]byte, error)
+	OpenReader(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	UploadFile(ctx context.Context, key string, data []byte, contentType string) error
+	DeleteFile(ctx context.Context, key string) error
+	FileExists(ctx context.Context, key string) (bool, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+
+	InitiateMultipart(ctx context.Context, key, contentType string) (string, error)
+	GetPresignedPartURL(ctx context.Context, key, uploadID string, partNumber int, expiry time.Duration) (string, error)
+	ListParts(ctx context.Context, key, uploadID string) ([]Part, error)
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+	ListIncompleteUploads(ctx context.Context, prefix string, olderThan time.Time) ([]IncompleteUpload, error)
+}
+
+var (
+	_ Store = (*MinioClient)(nil)
+	_ Store = (*LocalStore)(nil)
+)
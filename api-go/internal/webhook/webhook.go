@@ -0,0 +1,356 @@
+// Package webhook delivers events to subscribed HTTP endpoints. Deliveries
+// are stored in Postgres before they are sent, signed with the
+// subscription's secret and retried with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Event types.
+const (
+	EventImageIngested     = "image.ingested"
+	EventImageDeleted      = "image.deleted"
+	EventDuplicateDetected = "duplicate.detected"
+	EventAnomalyFlagged    = "anomaly.flagged"
+	EventFeedbackCreated   = "feedback.created"
+)
+
+// Events lists the event types subscriptions can choose from.
+var Events = []string{
+	EventImageIngested,
+	EventImageDeleted,
+	EventDuplicateDetected,
+	EventAnomalyFlagged,
+	EventFeedbackCreated,
+}
+
+// Delivery states.
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	// StatusCancelled marks deliveries left pending when their webhook was
+	// deactivated; they are not sent.
+	StatusCancelled = "cancelled"
+)
+
+const (
+	maxAttempts = 8
+	baseBackoff = 30 * time.Second
+	maxBackoff  = time.Hour
+	// claimLease keeps a claimed delivery from being sent twice by
+	// concurrent workers while its request is in flight.
+	claimLease = 2 * time.Minute
+	batchSize  = 20
+	pollEvery  = 10 * time.Second
+)
+
+// Sign returns the value of the X-Webhook-Signature header: the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the subscription secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff is the delay before retry number attempt (1-based).
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << (attempt - 1)
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+// Dispatcher records and sends webhook deliveries.
+type Dispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	wake   chan struct{}
+}
+
+// NewDispatcher returns a Dispatcher. client should refuse internal
+// addresses, since subscription URLs are user-supplied.
+func NewDispatcher(db *sql.DB, client *http.Client) *Dispatcher {
+	return &Dispatcher{db: db, client: client, wake: make(chan struct{}, 1)}
+}
+
+// Emit records a delivery of the event for every active subscription of
+// owner to it and wakes the sender. Failures are logged; events are never
+// worth failing the request that caused them.
+func (d *Dispatcher) Emit(ctx context.Context, owner, event string, data interface{}) {
+	if d == nil || d.db == nil || owner == "" {
+		return
+	}
+	now := time.Now().UTC()
+	body, err := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"created_at": now,
+		"data":       data,
+	})
+	if err != nil {
+		slog.Error("webhook: encoding event failed", "error", err, "event", event)
+		return
+	}
+	res, err := d.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+		SELECT id, $2, $3, $4, 0, $5, $5 FROM webhooks
+		WHERE user_id = $1 AND active AND $2 = ANY(events)
+	`, owner, event, string(body), StatusPending, now)
+	if err != nil {
+		slog.Error("webhook: recording deliveries failed", "error", err, "event", event)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		d.Wake()
+	}
+}
+
+// Subscribed reports whether owner has an active subscription to event, so
+// callers can skip work that only feeds that event.
+func (d *Dispatcher) Subscribed(ctx context.Context, owner, event string) bool {
+	if d == nil || d.db == nil || owner == "" {
+		return false
+	}
+	var exists bool
+	err := d.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM webhooks WHERE user_id = $1 AND active AND $2 = ANY(events))
+	`, owner, event).Scan(&exists)
+	if err != nil {
+		slog.Error("webhook: checking subscriptions failed", "error", err, "event", event)
+		return false
+	}
+	return exists
+}
+
+// Wake makes Run look for due deliveries now.
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	if d.db == nil {
+		return
+	}
+	ticker := time.NewTicker(pollEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+		for {
+			n, err := d.deliverDue(ctx)
+			if err != nil {
+				slog.Error("webhook: delivering failed", "error", err)
+				break
+			}
+			if n < batchSize {
+				break
+			}
+		}
+	}
+}
+
+type delivery struct {
+	id       int64
+	event    string
+	payload  string
+	attempts int
+	url      string
+	secret   string
+}
+
+// deliverDue claims and sends up to batchSize due deliveries of active
+// webhooks and returns how many it claimed. Pending deliveries of inactive
+// webhooks are cancelled first.
+func (d *Dispatcher) deliverDue(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries dl SET status = $2, last_error = 'webhook is inactive'
+		FROM webhooks w
+		WHERE w.id = dl.webhook_id AND NOT w.active AND dl.status = $1
+	`, StatusPending, StatusCancelled)
+	if err != nil {
+		return 0, err
+	}
+
+	// The claim checks active itself, as a webhook can be deactivated
+	// between the two statements.
+	rows, err := d.db.QueryContext(ctx, `
+		UPDATE webhook_deliveries dl SET next_attempt_at = $2
+		FROM webhooks w
+		WHERE w.id = dl.webhook_id AND dl.id IN (
+			SELECT dd.id FROM webhook_deliveries dd
+			JOIN webhooks ww ON ww.id = dd.webhook_id AND ww.active
+			WHERE dd.status = $3 AND dd.next_attempt_at <= $1
+			ORDER BY dd.next_attempt_at
+			LIMIT $4
+			FOR UPDATE OF dd SKIP LOCKED
+		)
+		RETURNING dl.id, dl.event, dl.payload, dl.attempts, w.url, w.secret
+	`, now, now.Add(claimLease), StatusPending, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var due []delivery
+	for rows.Next() {
+		var dl delivery
+		if err := rows.Scan(&dl.id, &dl.event, &dl.payload, &dl.attempts, &dl.url, &dl.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, dl)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, dl := range due {
+		d.send(ctx, dl)
+	}
+	return len(due), nil
+}
+
+// send makes one delivery attempt and records its outcome.
+func (d *Dispatcher) send(ctx context.Context, dl delivery) {
+	code, sendErr := d.post(ctx, dl)
+	attempts := dl.attempts + 1
+	now := time.Now().UTC()
+
+	if sendErr == nil {
+		_, err := d.db.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = $2, attempts = $3, last_status_code = $4, last_error = NULL, delivered_at = $5
+			WHERE id = $1
+		`, dl.id, StatusSucceeded, attempts, code, now)
+		if err != nil {
+			slog.Error("webhook: recording success failed", "error", err, "delivery_id", dl.id)
+		}
+		return
+	}
+
+	status, next := StatusPending, now.Add(backoff(attempts))
+	if attempts >= maxAttempts {
+		status = StatusFailed
+	}
+	slog.Warn("webhook: delivery attempt failed", "error", sendErr, "delivery_id", dl.id, "attempt", attempts, "status", status)
+	var statusCode *int
+	if code != 0 {
+		statusCode = &code
+	}
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, last_status_code = $4, last_error = $5, next_attempt_at = $6
+		WHERE id = $1
+	`, dl.id, status, attempts, statusCode, sendErr.Error(), next)
+	if err != nil {
+		slog.Error("webhook: recording failure failed", "error", err, "delivery_id", dl.id)
+	}
+}
+
+// post sends the delivery. Any 2xx response is a success.
+func (d *Dispatcher) post(ctx context.Context, dl delivery) (int, error) {
+	body := []byte(dl.payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "visual-anomaly-webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", dl.event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(dl.id, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", Sign(dl.secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Redeliver schedules a delivery of webhookID for another round of attempts,
+// whatever its state. It reports false when no such delivery exists.
+func (d *Dispatcher) Redeliver(ctx context.Context, webhookID, deliveryID int64) (bool, error) {
+	res, err := d.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $3, attempts = 0, next_attempt_at = $4, delivered_at = NULL
+		WHERE id = $1 AND webhook_id = $2
+	`, deliveryID, webhookID, StatusPending, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		d.Wake()
+	}
+	return n > 0, nil
+}
+
+// CancelPending cancels the pending deliveries of webhookID, which has been
+// deactivated, and returns how many it cancelled. Attempts already in
+// flight are cancelled by Run when they finish.
+func (d *Dispatcher) CancelPending(ctx context.Context, webhookID int64) (int64, error) {
+	if d == nil || d.db == nil {
+		return 0, nil
+	}
+	res, err := d.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET status = $3, last_error = 'webhook is inactive'
+		WHERE webhook_id = $1 AND status = $2
+	`, webhookID, StatusPending, StatusCancelled)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ValidEvents reports the first unknown event type in events, if any.
+func ValidEvents(events []string) (string, bool) {
+	for _, e := range events {
+		if !known(e) {
+			return e, false
+		}
+	}
+	return "", true
+}
+
+func known(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -51,8 +51,8 @@ export const authApi = {
 
 // Images API
 export const imagesApi = {
-  getPresignedUrl: async (fileName: string) => {
-    const { data } = await apiClient.post('/images/presign', { file_name: fileName })
+  getPresignedUrl: async (fileName: string, contentType?: string): Promise<PresignedUpload> => {
+    const { data } = await apiClient.post('/images/presign', { file_name: fileName, content_type: contentType || undefined })
     return data
   },
 
@@ -61,14 +61,22 @@ export const imagesApi = {
     return data
   },
 
+  ingestFromUrl: async (url: string, tags?: string[], album?: string) => {
+    const { data } = await apiClient.post('/images/ingest-url', { url, tags, album })
+    return data
+  },
+
   getImage: async (id: string) => {
     const { data } = await apiClient.get(`/images/${id}`)
     return data
   },
 
-  listImages: async (limit = 50) => {
-    const { data } = await apiClient.get(`/images`, { params: { limit } })
-    return data as { images: Array<{ image_id: string; payload: any; preview_url?: string }>; count: number }
+  listImages: async (limit = 50, thumbnail_size?: number) => {
+    const { data } = await apiClient.get(`/images`, { params: { limit, thumbnail_size } })
+    return data as {
+      images: Array<{ image_id: string; payload: any; preview_url?: string; thumbnail_url?: string }>
+      count: number
+    }
   },
 
   deleteImage: async (id: string) => {
@@ -91,11 +99,16 @@ export const imagesApi = {
 export const searchApi = {
   searchSimilar: async (params: {
     image_id?: string
+    image_url?: string
     text_query?: string
     limit?: number
     score_threshold?: number
     filter?: Record<string, any>
     include_payload?: boolean
+    group_by?: string
+    group_size?: number
+    diversity?: number
+    bbox?: { x: number; y: number; w: number; h: number; units?: 'px' | 'normalized' }
   }) => {
     const { data } = await apiClient.post('/search/similar', params)
     return data
@@ -105,6 +118,10 @@ export const searchApi = {
     limit?: number
     score_threshold?: number
     filter?: Record<string, any>
+    group_by?: string
+    group_size?: number
+    diversity?: number
+    bbox?: { x: number; y: number; w: number; h: number; units?: 'px' | 'normalized' }
   }) => {
     const formData = new FormData()
     formData.append('image', file)
@@ -112,6 +129,10 @@ export const searchApi = {
     if (params?.limit) formData.append('limit', params.limit.toString())
     if (params?.score_threshold) formData.append('score_threshold', params.score_threshold.toString())
     if (params?.filter) formData.append('filter', JSON.stringify(params.filter))
+    if (params?.group_by) formData.append('group_by', params.group_by)
+    if (params?.group_size) formData.append('group_size', params.group_size.toString())
+    if (params?.diversity) formData.append('diversity', params.diversity.toString())
+    if (params?.bbox) formData.append('bbox', JSON.stringify(params.bbox))
 
     const { data } = await apiClient.post('/search/similar', formData, {
       headers: {
@@ -121,6 +142,37 @@ export const searchApi = {
     return data
   },
 
+  recommend: async (params: {
+    positive?: string[]
+    negative?: string[]
+    use_feedback?: boolean
+    strategy?: 'recommend' | 'best_score' | 'rocchio'
+    image_id?: string
+    text_query?: string
+    limit?: number
+    score_threshold?: number
+    filter?: Record<string, any>
+    include_payload?: boolean
+  }) => {
+    const { data } = await apiClient.post('/search/recommend', params)
+    return data
+  },
+
+  batch: async (params: {
+    queries: {
+      image_id?: string
+      text_query?: string
+      limit?: number
+      score_threshold?: number
+      filter?: Record<string, any>
+    }[]
+    exclude_self?: boolean
+    include_payload?: boolean
+  }) => {
+    const { data } = await apiClient.post('/search/batch', params)
+    return data
+  },
+
   cluster: async (params: {
     image_ids?: string[]
     filter?: Record<string, any>
@@ -131,9 +183,12 @@ export const searchApi = {
     return data
   },
 
-  deduplicate: async (params?: { limit?: number; score_threshold?: number }) => {
+  deduplicate: async (params?: { limit?: number; score_threshold?: number; thumbnail_size?: number }) => {
     const { data } = await apiClient.post('/deduplicate', params || {})
-    return data as { clusters: Array<{ images: Array<{ image_id: string; preview_url?: string; score?: number }> }>; count: number }
+    return data as {
+      clusters: Array<{ images: Array<{ image_id: string; preview_url?: string; thumbnail_url?: string; score?: number }> }>
+      count: number
+    }
   },
 }
 
@@ -154,13 +209,184 @@ export const qaApi = {
   },
 }
 
+// Saved searches API
+export const savedSearchesApi = {
+  list: async () => {
+    const { data } = await apiClient.get('/saved-searches')
+    return data
+  },
+
+  create: async (params: {
+    name: string
+    image_id?: string
+    text_query?: string
+    filter?: Record<string, any>
+    score_threshold: number
+  }) => {
+    const { data } = await apiClient.post('/saved-searches', params)
+    return data
+  },
+
+  remove: async (id: number) => {
+    const { data } = await apiClient.delete(`/saved-searches/${id}`)
+    return data
+  },
+
+  matches: async (id: number, params?: { limit?: number; offset?: number; unseen?: boolean }) => {
+    const { data } = await apiClient.get(`/saved-searches/${id}/matches`, { params })
+    return data
+  },
+
+  markSeen: async (id: number) => {
+    const { data } = await apiClient.post(`/saved-searches/${id}/matches/seen`)
+    return data
+  },
+}
+
+export const webhooksApi = {
+  list: async () => {
+    const { data } = await apiClient.get('/webhooks')
+    return data
+  },
+
+  create: async (params: { url: string; events: string[]; secret?: string }) => {
+    const { data } = await apiClient.post('/webhooks', params)
+    return data
+  },
+
+  setActive: async (id: number, active: boolean) => {
+    const { data } = await apiClient.patch(`/webhooks/${id}`, { active })
+    return data
+  },
+
+  remove: async (id: number) => {
+    const { data } = await apiClient.delete(`/webhooks/${id}`)
+    return data
+  },
+
+  deliveries: async (id: number, params?: { limit?: number; offset?: number; status?: string }) => {
+    const { data } = await apiClient.get(`/webhooks/${id}/deliveries`, { params })
+    return data
+  },
+
+  redeliver: async (id: number, deliveryId: number) => {
+    const { data } = await apiClient.post(`/webhooks/${id}/deliveries/${deliveryId}/redeliver`)
+    return data
+  },
+}
+
 // Upload file to S3 using presigned URL
-export const uploadToS3 = async (url: string, file: File) => {
+export interface PresignedUpload {
+  bucket: string
+  key: string
+  url: string
+  method: 'POST'
+  fields: Record<string, string>
+  content_type: string
+  max_bytes: number
+  expires: string
+  image_id: string
+}
+
+export const uploadToS3 = async (presign: PresignedUpload, file: File) => {
   // If the presigned URL points to the internal Docker hostname, proxy via our web server
-  const browserUrl = url.replace(/^https?:\/\/minio:9000/, S3_PROXY_BASE)
-  await axios.put(browserUrl, file, {
-    headers: {
-      'Content-Type': file.type,
-    },
-  })
+  const browserUrl = presign.url.replace(/^https?:\/\/minio:9000/, S3_PROXY_BASE)
+  // The policy fields come first; the file must be the last field
+  const form = new FormData()
+  Object.entries(presign.fields).forEach(([name, value]) => form.append(name, value))
+  form.append('file', file)
+  await axios.post(browserUrl, form)
+}
+
+// Multipart uploads for large files
+export interface MultipartUpload {
+  image_id: string
+  key: string
+  content_type: string
+  size: number
+  part_size: number
+  part_count: number
+  state: 'uploading' | 'completed' | 'aborted' | 'expired'
+  created_at: string
+  expires_at: string
+  completed_at?: string
+}
+
+export interface UploadPart {
+  part_number: number
+  size: number
+  url: string
+}
+
+export interface UploadStatus {
+  upload: MultipartUpload
+  bucket: string
+  parts?: UploadPart[]
+  uploaded_parts?: Array<{ part_number: number; size: number; etag: string }>
+}
+
+export const uploadsApi = {
+  create: async (fileName: string, size: number, contentType?: string): Promise<UploadStatus> => {
+    const { data } = await apiClient.post('/images/uploads', { file_name: fileName, size, content_type: contentType || undefined })
+    return data
+  },
+
+  get: async (id: string): Promise<UploadStatus> => {
+    const { data } = await apiClient.get(`/images/uploads/${id}`)
+    return data
+  },
+
+  complete: async (id: string): Promise<UploadStatus> => {
+    const { data } = await apiClient.post(`/images/uploads/${id}/complete`)
+    return data
+  },
+
+  abort: async (id: string) => {
+    const { data } = await apiClient.delete(`/images/uploads/${id}`)
+    return data
+  },
+}
+
+// Files larger than this are sent as multipart uploads
+export const MULTIPART_THRESHOLD = 8 * 1024 * 1024
+
+const PART_RETRIES = 3
+
+// uploadMultipart sends file in parts and returns where it was stored. The
+// upload ID is kept in localStorage, so uploading the same file again, even
+// after a reload, resumes with the parts that are still missing.
+export const uploadMultipart = async (file: File, onProgress?: (fraction: number) => void) => {
+  const resumeKey = `upload:${file.name}:${file.size}:${file.lastModified}`
+  let status: UploadStatus | undefined
+  const saved = localStorage.getItem(resumeKey)
+  if (saved) {
+    status = await uploadsApi.get(saved).catch(() => undefined)
+    if (status?.upload.state !== 'uploading') status = undefined
+  }
+  if (!status) {
+    status = await uploadsApi.create(file.name, file.size, file.type)
+    localStorage.setItem(resumeKey, status.upload.image_id)
+  }
+
+  const { upload } = status
+  let done = upload.part_count - (status.parts?.length ?? 0)
+  for (const part of status.parts ?? []) {
+    const start = (part.part_number - 1) * upload.part_size
+    const blob = file.slice(start, start + part.size)
+    const browserUrl = part.url.replace(/^https?:\/\/minio:9000/, S3_PROXY_BASE)
+    for (let attempt = 1; ; attempt++) {
+      try {
+        await axios.put(browserUrl, blob)
+        break
+      } catch (err) {
+        if (attempt >= PART_RETRIES) throw err
+      }
+    }
+    done++
+    onProgress?.(done / upload.part_count)
+  }
+
+  const completed = await uploadsApi.complete(upload.image_id)
+  localStorage.removeItem(resumeKey)
+  return { bucket: completed.bucket, key: completed.upload.key }
 }
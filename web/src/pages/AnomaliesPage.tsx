@@ -9,6 +9,7 @@ interface Anomaly {
   image_id: string
   anomaly_score: number
   preview_url: string
+  thumbnail_url?: string
   payload: any
 }
 
@@ -103,7 +104,7 @@ export function AnomaliesPage() {
               {anomalies.map((anomaly: Anomaly) => (
                 <div key={anomaly.image_id} className="border rounded-lg overflow-hidden">
                   <div className="aspect-video relative">
-                    <img src={anomaly.preview_url} alt={`Anomaly ${anomaly.image_id}`} className="w-full h-full object-cover" />
+                    <img src={anomaly.thumbnail_url || anomaly.preview_url} alt={`Anomaly ${anomaly.image_id}`} className="w-full h-full object-cover" />
                     <div className="absolute top-2 right-2 bg-red-500 text-white px-2 py-1 rounded text-sm font-semibold">
                       {(anomaly.anomaly_score * 100).toFixed(1)}%
                     </div>
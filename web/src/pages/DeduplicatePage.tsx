@@ -97,8 +97,8 @@ export function DeduplicatePage() {
                   {cluster.images.map((image: any) => (
                     <div key={String(image.image_id)} className="relative group cursor-pointer">
                       <div className="aspect-square rounded-lg overflow-hidden border-2 border-transparent hover:border-primary transition-colors">
-                        {image.preview_url ? (
-                          <img src={image.preview_url} alt={`Image ${image.image_id}`} className="w-full h-full object-cover" />
+                        {image.thumbnail_url || image.preview_url ? (
+                          <img src={image.thumbnail_url || image.preview_url} alt={`Image ${image.image_id}`} className="w-full h-full object-cover" />
                         ) : (
                           <div className="w-full h-full flex items-center justify-center text-xs text-muted-foreground">No preview</div>
                         )}
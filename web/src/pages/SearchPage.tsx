@@ -5,8 +5,8 @@ import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/com
 import { Input } from '@/components/ui/input'
 import { Button } from '@/components/ui/button'
 import { Label } from '@/components/ui/label'
-import { searchApi } from '@/api/client'
-import { Search, Image as ImageIcon, Type, Loader2 } from 'lucide-react'
+import { searchApi, qaApi } from '@/api/client'
+import { Search, Image as ImageIcon, Type, Loader2, ThumbsUp, ThumbsDown, Sparkles } from 'lucide-react'
 import { useDropzone } from 'react-dropzone'
 import { cn } from '@/lib/utils'
 
@@ -14,9 +14,16 @@ interface SearchResult {
   image_id: string
   score: number
   preview_url: string
+  thumbnail_url?: string
   payload?: any
 }
 
+interface SearchGroup {
+  group_id: string | number
+  hits: SearchResult[]
+  count: number
+}
+
 export function SearchPage() {
   const [searchType, setSearchType] = useState<'image' | 'text'>('image')
   const [imageFile, setImageFile] = useState<File | null>(null)
@@ -24,17 +31,32 @@ export function SearchPage() {
   const [textQuery, setTextQuery] = useState('')
   const [limit, setLimit] = useState(20)
   const [scoreThreshold, setScoreThreshold] = useState(0.5)
+  const [groupBy, setGroupBy] = useState('')
+  const [groupSize, setGroupSize] = useState(3)
+  const [diversity, setDiversity] = useState(0)
   const [searchParams, setSearchParams] = useState<any>(null)
+  const [marks, setMarks] = useState<Record<string, 'relevant' | 'irrelevant'>>({})
 
   const { data, isLoading } = useQuery({
     queryKey: ['search', searchParams],
     queryFn: async () => {
       if (!searchParams) return null
       
-      if (searchParams.type === 'image' && searchParams.file) {
+      if (searchParams.type === 'refine') {
+        return await searchApi.recommend({
+          positive: searchParams.positive,
+          negative: searchParams.negative,
+          limit: searchParams.limit,
+          score_threshold: searchParams.scoreThreshold,
+          include_payload: true,
+        })
+      } else if (searchParams.type === 'image' && searchParams.file) {
         return await searchApi.searchByImage(searchParams.file, {
           limit: searchParams.limit,
           score_threshold: searchParams.scoreThreshold,
+          group_by: searchParams.groupBy || undefined,
+          group_size: searchParams.groupSize,
+          diversity: searchParams.diversity,
         })
       } else if (searchParams.type === 'text' && searchParams.query) {
         return await searchApi.searchSimilar({
@@ -42,6 +64,9 @@ export function SearchPage() {
           limit: searchParams.limit,
           score_threshold: searchParams.scoreThreshold,
           include_payload: true,
+          group_by: searchParams.groupBy || undefined,
+          group_size: searchParams.groupSize,
+          diversity: searchParams.diversity,
         })
       }
       
@@ -61,11 +86,29 @@ export function SearchPage() {
   const { getRootProps, getInputProps, isDragActive } = useDropzone({
     onDrop,
     accept: {
-      'image/*': ['.png', '.jpg', '.jpeg', '.gif', '.webp'],
+      'image/*': ['.png', '.jpg', '.jpeg', '.gif', '.webp', '.bmp', '.tif', '.tiff', '.heic', '.heif', '.avif'],
     },
     maxFiles: 1,
   })
 
+  const markResult = async (imageId: string, action: 'relevant' | 'irrelevant') => {
+    setMarks((prev) => ({ ...prev, [imageId]: action }))
+    await qaApi.submitFeedback(imageId, action)
+  }
+
+  const positiveIds = Object.keys(marks).filter((id) => marks[id] === 'relevant')
+  const negativeIds = Object.keys(marks).filter((id) => marks[id] === 'irrelevant')
+
+  const handleRefine = () => {
+    setSearchParams({
+      type: 'refine',
+      positive: positiveIds,
+      negative: negativeIds,
+      limit,
+      scoreThreshold,
+    })
+  }
+
   const handleSearch = () => {
     if (searchType === 'image' && imageFile) {
       setSearchParams({
@@ -73,6 +116,9 @@ export function SearchPage() {
         file: imageFile,
         limit,
         scoreThreshold,
+        groupBy,
+        groupSize,
+        diversity,
       })
     } else if (searchType === 'text' && textQuery) {
       setSearchParams({
@@ -80,6 +126,9 @@ export function SearchPage() {
         query: textQuery,
         limit,
         scoreThreshold,
+        groupBy,
+        groupSize,
+        diversity,
       })
     }
   }
@@ -91,6 +140,49 @@ export function SearchPage() {
     setSearchParams(null)
   }
 
+  const renderResult = (result: SearchResult) => (
+    <div
+      key={result.image_id}
+      className="relative group overflow-hidden rounded-lg border"
+    >
+      <div className="aspect-square relative">
+        <img
+          src={result.thumbnail_url || result.preview_url}
+          alt={`Result ${result.image_id}`}
+          className="w-full h-full object-cover"
+        />
+        <div className="absolute inset-0 bg-black/50 flex flex-col items-center justify-center opacity-0 group-hover:opacity-100 transition-opacity p-2">
+          <p className="text-white text-xs mt-1">
+            ID: {result.image_id.slice(0, 8)}...
+          </p>
+        </div>
+      </div>
+      <div className="p-2 bg-gray-50 border-t flex items-center justify-between">
+        <p className="text-sm font-semibold text-gray-700">
+          Score: {result.score.toFixed(3)}
+        </p>
+        <div className="flex gap-1">
+          <button
+            type="button"
+            title="Relevant"
+            onClick={() => markResult(result.image_id, 'relevant')}
+            className={cn('p-1 rounded', marks[result.image_id] === 'relevant' ? 'text-green-600' : 'text-gray-400')}
+          >
+            <ThumbsUp className="h-4 w-4" />
+          </button>
+          <button
+            type="button"
+            title="Irrelevant"
+            onClick={() => markResult(result.image_id, 'irrelevant')}
+            className={cn('p-1 rounded', marks[result.image_id] === 'irrelevant' ? 'text-red-600' : 'text-gray-400')}
+          >
+            <ThumbsDown className="h-4 w-4" />
+          </button>
+        </div>
+      </div>
+    </div>
+  )
+
   return (
     <div className="space-y-6">
       <div>
@@ -192,6 +284,40 @@ export function SearchPage() {
                 onChange={(e) => setScoreThreshold(parseFloat(e.target.value) || 0.5)}
               />
             </div>
+            <div className="space-y-2">
+              <Label htmlFor="group-by">Group By (optional)</Label>
+              <Input
+                id="group-by"
+                placeholder="e.g., tags, source, sku"
+                value={groupBy}
+                onChange={(e) => setGroupBy(e.target.value.trim())}
+              />
+            </div>
+            <div className="space-y-2">
+              <Label htmlFor="group-size">Results per Group</Label>
+              <Input
+                id="group-size"
+                type="number"
+                min="1"
+                max="20"
+                value={groupSize}
+                disabled={!groupBy}
+                onChange={(e) => setGroupSize(parseInt(e.target.value) || 3)}
+              />
+            </div>
+            <div className="space-y-2">
+              <Label htmlFor="diversity">Diversity (0 = off)</Label>
+              <Input
+                id="diversity"
+                type="number"
+                min="0"
+                max="1"
+                step="0.1"
+                value={diversity}
+                disabled={!!groupBy}
+                onChange={(e) => setDiversity(parseFloat(e.target.value) || 0)}
+              />
+            </div>
           </div>
 
           <div className="flex gap-4 mt-6">
@@ -219,36 +345,36 @@ export function SearchPage() {
           <CardHeader>
             <CardTitle>Search Results</CardTitle>
             <CardDescription>
-              Found {data.results.length} similar images
+              {data.groups
+                ? `Found ${data.groups.length} groups by ${data.group_by}.`
+                : `Found ${data.results.length} similar images.`} Mark results as relevant or irrelevant, then refine.
             </CardDescription>
+            <div className="mt-2">
+              <Button size="sm" variant="outline" onClick={handleRefine} disabled={isLoading || positiveIds.length === 0}>
+                <Sparkles className="mr-2 h-4 w-4" />
+                Refine ({positiveIds.length} relevant, {negativeIds.length} irrelevant)
+              </Button>
+            </div>
           </CardHeader>
           <CardContent>
-            <div className="grid grid-cols-2 md:grid-cols-3 lg:grid-cols-4 gap-4">
-              {data.results.map((result: SearchResult) => (
-                <div
-                  key={result.image_id}
-                  className="relative group overflow-hidden rounded-lg border"
-                >
-                  <div className="aspect-square relative">
-                    <img
-                      src={result.preview_url}
-                      alt={`Result ${result.image_id}`}
-                      className="w-full h-full object-cover"
-                    />
-                    <div className="absolute inset-0 bg-black/50 flex flex-col items-center justify-center opacity-0 group-hover:opacity-100 transition-opacity p-2">
-                      <p className="text-white text-xs mt-1">
-                        ID: {result.image_id.slice(0, 8)}...
-                      </p>
-                    </div>
-                  </div>
-                  <div className="p-2 bg-gray-50 border-t">
-                    <p className="text-sm font-semibold text-gray-700">
-                      Score: {result.score.toFixed(3)}
+            {data.groups ? (
+              <div className="space-y-6">
+                {data.groups.map((group: SearchGroup) => (
+                  <div key={String(group.group_id)} className="space-y-2">
+                    <p className="text-sm font-medium">
+                      {data.group_by}: {String(group.group_id)}
                     </p>
+                    <div className="grid grid-cols-2 md:grid-cols-3 lg:grid-cols-4 gap-4">
+                      {group.hits.map(renderResult)}
+                    </div>
                   </div>
-                </div>
-              ))}
-            </div>
+                ))}
+              </div>
+            ) : (
+              <div className="grid grid-cols-2 md:grid-cols-3 lg:grid-cols-4 gap-4">
+                {data.results.map(renderResult)}
+              </div>
+            )}
           </CardContent>
         </Card>
       )}
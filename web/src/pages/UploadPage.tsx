@@ -4,7 +4,7 @@ import { useMutation } from '@tanstack/react-query'
 import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/components/ui/card'
 import { Button } from '@/components/ui/button'
 import { useToast } from '@/components/ui/use-toast'
-import { imagesApi, uploadToS3 } from '@/api/client'
+import { imagesApi, uploadToS3, uploadMultipart, MULTIPART_THRESHOLD } from '@/api/client'
 import { Upload, Image as ImageIcon, CheckCircle, Trash2, RefreshCw, Image as ImageGen } from 'lucide-react'
 import { cn } from '@/lib/utils'
 
@@ -25,7 +25,7 @@ export function UploadPage() {
     imagesApi
       .listImages(50)
       .then((res) => {
-        setPersisted(res.images.map((it) => ({ image_id: String(it.image_id), preview_url: it.preview_url })))
+        setPersisted(res.images.map((it) => ({ image_id: String(it.image_id), preview_url: it.thumbnail_url || it.preview_url })))
       })
       .catch(() => {})
   }
@@ -36,11 +36,18 @@ export function UploadPage() {
 
   const uploadMutation = useMutation({
     mutationFn: async (uploadFile: UploadedFile) => {
-      const presignData = await imagesApi.getPresignedUrl(uploadFile.file.name)
-      updateFileStatus(uploadFile.file.name, 'uploading')
-      await uploadToS3(presignData.url, uploadFile.file)
+      let stored: { bucket: string; key: string }
+      if (uploadFile.file.size > MULTIPART_THRESHOLD) {
+        updateFileStatus(uploadFile.file.name, 'uploading')
+        stored = await uploadMultipart(uploadFile.file)
+      } else {
+        const presignData = await imagesApi.getPresignedUrl(uploadFile.file.name, uploadFile.file.type)
+        updateFileStatus(uploadFile.file.name, 'uploading')
+        await uploadToS3(presignData, uploadFile.file)
+        stored = presignData
+      }
       updateFileStatus(uploadFile.file.name, 'processing')
-      const ingestData = await imagesApi.ingest(presignData.bucket, presignData.key)
+      const ingestData = await imagesApi.ingest(stored.bucket, stored.key)
       updateFileStatus(uploadFile.file.name, 'completed', ingestData.image_id)
       return ingestData
     },
@@ -104,8 +111,8 @@ export function UploadPage() {
 
   const { getRootProps, getInputProps, isDragActive } = useDropzone({
     onDrop,
-    accept: { 'image/*': ['.png', '.jpg', '.jpeg', '.gif', '.webp'] },
-    maxSize: 10 * 1024 * 1024,
+    accept: { 'image/*': ['.png', '.jpg', '.jpeg', '.gif', '.webp', '.bmp', '.tif', '.tiff', '.heic', '.heif', '.avif'] },
+    maxSize: 20 * 1024 * 1024,
   })
 
   const clearCompleted = () => {
@@ -170,7 +177,7 @@ export function UploadPage() {
             <input {...getInputProps()} />
             <Upload className="mx-auto h-12 w-12 text-muted-foreground" />
             <p className="mt-4 text-sm text-muted-foreground">{isDragActive ? "Drop the images here..." : "Drag 'n' drop images here, or click to select"}</p>
-            <p className="mt-2 text-xs text-muted-foreground">PNG, JPG, JPEG, GIF, WebP up to 10MB</p>
+            <p className="mt-2 text-xs text-muted-foreground">PNG, JPG, GIF, WebP, BMP, TIFF, HEIC, AVIF up to 20MB</p>
           </div>
         </CardContent>
       </Card>